@@ -0,0 +1,145 @@
+package ftp
+
+import (
+	"os"
+	"path"
+)
+
+// Access is a set of operations that may be performed on a path.
+type Access uint
+
+// Operations checked by an AccessControl.
+const (
+	AccessRead   Access = 1 << iota // Read a file.
+	AccessWrite                     // Create or overwrite a file.
+	AccessAppend                    // Append to a file.
+	AccessDelete                    // Delete a file or directory.
+	AccessRename                    // Rename a file or directory.
+	AccessMkdir                     // Make a directory.
+	AccessList                      // List, stat or enter a path.
+
+	AccessAll = AccessRead | AccessWrite | AccessAppend | AccessDelete |
+		AccessRename | AccessMkdir | AccessList
+)
+
+// An AccessControl can be used with a FileHandler to restrict operations.
+type AccessControl interface {
+	// Allow returns whether user, a member of groups, may perform op on the
+	// absolute path p.
+	Allow(user string, groups []string, op Access, p string) bool
+}
+
+// An ACLRule allows or denies operations on paths matching a pattern.
+type ACLRule struct {
+	Users  []string // Users the rule applies to.
+	Groups []string // Groups the rule applies to. If both are nil, all users.
+	Path   string   // Path pattern with the syntax of path.Match.
+	Allow  Access   // Operations to allow.
+	Deny   Access   // Operations to deny.
+}
+
+// An ACL is an AccessControl made of rules. For each operation, the first
+// rule that applies to the user and path and either allows or denies the
+// operation decides. If no rule decides, the operation is denied. A rule
+// whose pattern matches a directory also applies to everything under it.
+type ACL []ACLRule
+
+var _ AccessControl = ACL(nil)
+
+// Allow implements AccessControl.
+func (a ACL) Allow(user string, groups []string, op Access, p string) bool {
+	p = path.Join("/", p)
+	for _, r := range a {
+		if !r.applies(user, groups) || !r.matches(p) {
+			continue
+		}
+		if r.Deny&op != 0 {
+			return false
+		}
+		if r.Allow&op == op {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if the rule applies to a user.
+func (r *ACLRule) applies(user string, groups []string) bool {
+	if r.Users == nil && r.Groups == nil {
+		return true
+	}
+	for _, u := range r.Users {
+		if u == user {
+			return true
+		}
+	}
+	for _, g := range r.Groups {
+		for _, gg := range groups {
+			if g == gg {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check if the rule's pattern matches p or one of its parents.
+func (r *ACLRule) matches(p string) bool {
+	for {
+		if ok, _ := path.Match(r.Path, p); ok {
+			return true
+		}
+		if p == "/" {
+			return false
+		}
+		p = path.Dir(p)
+	}
+}
+
+// Check that the user may perform op on p. This returns a permission error if
+// not.
+func (s *fileSession) access(op Access, p string) error {
+	if s.ACL == nil {
+		return nil
+	}
+	var groups []string
+	if s.settings != nil {
+		groups = s.settings.Groups
+	}
+	if !s.ACL.Allow(s.User, groups, op, p) {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+// Hide entries of dir the user may not list.
+func (s *fileSession) listable(dir string, list []os.FileInfo) []os.FileInfo {
+	if s.ACL == nil {
+		return list
+	}
+	out := list[:0]
+	for _, fi := range list {
+		if s.access(AccessList, path.Join(dir, fi.Name())) == nil {
+			out = append(out, fi)
+		}
+	}
+	return out
+}
+
+// A listFile is a directory that hides entries the user may not list.
+type listFile struct {
+	File
+	s   *fileSession
+	dir string
+}
+
+// Readdir implements File.
+func (f *listFile) Readdir(n int) ([]os.FileInfo, error) {
+	for {
+		list, err := f.File.Readdir(n)
+		list = f.s.listable(f.dir, list)
+		if len(list) > 0 || err != nil || n <= 0 {
+			return list, err
+		}
+	}
+}
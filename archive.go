@@ -0,0 +1,438 @@
+package ftp
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ArchiveFileSystem is a read-only FileSystem serving the contents of a zip
+// or tar archive, which may be gzip compressed. Directories missing from the
+// archive are added for the paths of its entries.
+//
+// Files stored uncompressed in a zip, and regular files of an uncompressed
+// tar, can seek to any offset. Other files can only seek forward, and each
+// file of a gzip compressed tar is read by decompressing the archive up to it.
+type ArchiveFileSystem struct {
+	*fromFS
+	closer io.Closer
+}
+
+var (
+	_ LstatFS    = (*ArchiveFileSystem)(nil)
+	_ ReadlinkFS = (*ArchiveFileSystem)(nil)
+)
+
+// OpenArchive opens the archive at name. It should be closed when done.
+func OpenArchive(name string) (*ArchiveFileSystem, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	a, err := NewArchive(file, fi.Size())
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	a.closer = file
+	return a, nil
+}
+
+// NewArchive reads the index of an archive of the given size from r.
+func NewArchive(r io.ReaderAt, size int64) (*ArchiveFileSystem, error) {
+	magic := make([]byte, 4)
+	n, err := r.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	magic = magic[:n]
+	a := &archiveFS{root: newArchiveDir(time.Time{})}
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK")):
+		err = a.readZip(r, size)
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		err = a.readTar(r, size, true)
+	default:
+		err = a.readTar(r, size, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ArchiveFileSystem{fromFS: &fromFS{a}}, nil
+}
+
+// Close closes the archive file, if opened by OpenArchive.
+func (a *ArchiveFileSystem) Close() error {
+	if a.closer == nil {
+		return nil
+	}
+	return a.closer.Close()
+}
+
+// An archiveFS is an fs.FS of the entries of an archive.
+type archiveFS struct {
+	root *archiveEntry
+}
+
+var (
+	_ fs.StatFS  = (*archiveFS)(nil)
+	_ readLinkFS = (*archiveFS)(nil)
+)
+
+// An entry of an archive.
+type archiveEntry struct {
+	stat
+	children map[string]*archiveEntry // Entries of a directory.
+	target   string                   // Target of a link.
+
+	// Data of a seekable file, or else a function to read it.
+	data *io.SectionReader
+	open func() (io.ReadCloser, error)
+}
+
+func newArchiveDir(mtime time.Time) *archiveEntry {
+	return &archiveEntry{
+		stat:     stat{mode: os.ModeDir | 0555, time: mtime},
+		children: make(map[string]*archiveEntry),
+	}
+}
+
+// Read the index of a zip archive.
+func (a *archiveFS) readZip(r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		e := &archiveEntry{stat: stat{
+			size: int64(f.UncompressedSize64),
+			mode: f.Mode(),
+			time: f.Modified,
+		}}
+		switch {
+		case e.mode.IsDir():
+			e.size = 0
+		case e.mode&os.ModeSymlink != 0:
+			target, err := readZipLink(f)
+			if err != nil {
+				return err
+			}
+			e.target = target
+		case !e.mode.IsRegular():
+			continue
+		case f.Method == zip.Store:
+			off, err := f.DataOffset()
+			if err != nil {
+				return err
+			}
+			e.data = io.NewSectionReader(r, off, int64(f.CompressedSize64))
+		default:
+			e.open = f.Open
+		}
+		a.add(f.Name, e)
+	}
+	return nil
+}
+
+// Read the target of a link in a zip archive.
+func readZipLink(f *zip.File) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(io.LimitReader(rc, 4096))
+	return string(b), err
+}
+
+// Read the index of a tar archive, which is gzip compressed if gz is set.
+func (a *archiveFS) readTar(r io.ReaderAt, size int64, gz bool) error {
+	open := func(sr *io.SectionReader) (*tar.Reader, io.Closer, error) {
+		if !gz {
+			return tar.NewReader(sr), io.NopCloser(nil), nil
+		}
+		zr, err := gzip.NewReader(sr)
+		if err != nil {
+			return nil, nil, err
+		}
+		return tar.NewReader(zr), zr, nil
+	}
+	// Read a file by reading the archive up to its header.
+	rescan := func(index int) func() (io.ReadCloser, error) {
+		return func() (io.ReadCloser, error) {
+			tr, c, err := open(io.NewSectionReader(r, 0, size))
+			if err != nil {
+				return nil, err
+			}
+			for i := 0; i <= index; i++ {
+				if _, err := tr.Next(); err != nil {
+					c.Close()
+					return nil, err
+				}
+			}
+			return struct {
+				io.Reader
+				io.Closer
+			}{tr, c}, nil
+		}
+	}
+
+	sr := io.NewSectionReader(r, 0, size)
+	tr, c, err := open(sr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	for i := 0; ; i++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		fi := hdr.FileInfo()
+		e := &archiveEntry{stat: stat{
+			size: hdr.Size,
+			mode: fi.Mode(),
+			time: hdr.ModTime,
+		}}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			e.size = 0
+		case tar.TypeSymlink:
+			e.size, e.target = 0, hdr.Linkname
+		case tar.TypeLink:
+			t, err := a.lookup(hdr.Linkname, true)
+			if err != nil || t.mode.IsDir() {
+				continue
+			}
+			e = &archiveEntry{stat: t.stat, data: t.data, open: t.open}
+		case tar.TypeReg, tar.TypeGNUSparse:
+			if gz || hdr.Typeflag == tar.TypeGNUSparse || isSparse(hdr) {
+				e.open = rescan(i)
+				break
+			}
+			off, err := sr.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return err
+			}
+			e.data = io.NewSectionReader(r, off, hdr.Size)
+		default:
+			continue
+		}
+		a.add(hdr.Name, e)
+	}
+}
+
+// Whether a tar file is sparse, so its data is not stored contiguously.
+func isSparse(hdr *tar.Header) bool {
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// Add an entry at p, adding any missing parent directories.
+func (a *archiveFS) add(p string, e *archiveEntry) {
+	names := splitPath(p)
+	if len(names) == 0 {
+		return
+	}
+	dir := a.root
+	for _, name := range names[:len(names)-1] {
+		d := dir.children[name]
+		if d == nil || !d.mode.IsDir() {
+			d = newArchiveDir(e.time)
+			d.name = name
+			dir.children[name] = d
+		}
+		dir = d
+	}
+	name := names[len(names)-1]
+	e.name = name
+	if old := dir.children[name]; old != nil && old.mode.IsDir() && e.mode.IsDir() {
+		// Keep entries found before the directory itself.
+		e.children = old.children
+	} else if e.mode.IsDir() {
+		e.children = make(map[string]*archiveEntry)
+	}
+	dir.children[name] = e
+}
+
+// Return the entry at p. Links are followed, except at the end of p unless
+// follow is set.
+func (a *archiveFS) lookup(p string, follow bool) (*archiveEntry, error) {
+	parts := splitPath(p)
+	e, cur := a.root, "/"
+	links := 0
+	for i := 0; i < len(parts); i++ {
+		if !e.mode.IsDir() {
+			return nil, errNotDir
+		}
+		c := e.children[parts[i]]
+		if c == nil {
+			return nil, fs.ErrNotExist
+		}
+		last := i == len(parts)-1
+		if c.mode&os.ModeSymlink != 0 && (!last || follow) {
+			if links++; links > maxLinks {
+				return nil, errLinkLoop
+			}
+			target := c.target
+			if !path.IsAbs(target) {
+				target = path.Join(cur, target)
+			}
+			parts = append(splitPath(target), parts[i+1:]...)
+			e, cur, i = a.root, "/", -1
+			continue
+		}
+		e, cur = c, path.Join(cur, parts[i])
+	}
+	return e, nil
+}
+
+// Return the entry at name, following links.
+func (a *archiveFS) resolve(op, name string, follow bool) (*archiveEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	e, err := a.lookup(name, follow)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return e, nil
+}
+
+// Open implements fs.FS.
+func (a *archiveFS) Open(name string) (fs.File, error) {
+	e, err := a.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	info := e.info(name)
+	switch {
+	case e.mode.IsDir():
+		return &archiveDir{info: &info, entries: e.list()}, nil
+	case e.data != nil:
+		sr := io.NewSectionReader(e.data, 0, e.data.Size())
+		return &archiveSeekFile{archiveFile{sr, io.NopCloser(nil), &info}}, nil
+	}
+	rc, err := e.open()
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &archiveFile{rc, rc, &info}, nil
+}
+
+// Stat implements fs.StatFS.
+func (a *archiveFS) Stat(name string) (fs.FileInfo, error) {
+	e, err := a.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	info := e.info(name)
+	return &info, nil
+}
+
+// Lstat implements fs.ReadLinkFS of Go 1.25.
+func (a *archiveFS) Lstat(name string) (fs.FileInfo, error) {
+	e, err := a.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	info := e.info(name)
+	return &info, nil
+}
+
+// ReadLink implements fs.ReadLinkFS of Go 1.25.
+func (a *archiveFS) ReadLink(name string) (string, error) {
+	e, err := a.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	} else if e.mode&os.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: errNotLink}
+	}
+	return e.target, nil
+}
+
+// Return the stat of an entry opened as name.
+func (e *archiveEntry) info(name string) stat {
+	info := e.stat
+	if name == "." {
+		info.name = "."
+	}
+	return info
+}
+
+// Return the entries of a directory, sorted by name.
+func (e *archiveEntry) list() []fs.DirEntry {
+	list := make([]fs.DirEntry, 0, len(e.children))
+	for _, c := range e.children {
+		info := c.stat
+		list = append(list, fs.FileInfoToDirEntry(&info))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name() < list[j].Name()
+	})
+	return list
+}
+
+// An archiveFile is an open file of an archiveFS.
+type archiveFile struct {
+	r    io.Reader
+	c    io.Closer
+	info *stat
+}
+
+func (f *archiveFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *archiveFile) Read(b []byte) (int, error) { return f.r.Read(b) }
+func (f *archiveFile) Close() error               { return f.c.Close() }
+
+// An archiveSeekFile is an archiveFile that can seek.
+type archiveSeekFile struct {
+	archiveFile
+}
+
+func (f *archiveSeekFile) Seek(offset int64, whence int) (int64, error) {
+	return f.r.(io.Seeker).Seek(offset, whence)
+}
+
+// An archiveDir is an open directory of an archiveFS.
+type archiveDir struct {
+	info    *stat
+	entries []fs.DirEntry
+}
+
+func (d *archiveDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *archiveDir) Close() error               { return nil }
+
+func (d *archiveDir) Read(b []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errIsDir}
+}
+
+func (d *archiveDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 || n > len(d.entries) {
+		if n > 0 && len(d.entries) == 0 {
+			return nil, io.EOF
+		}
+		n = len(d.entries)
+	}
+	list := d.entries[:n:n]
+	d.entries = d.entries[n:]
+	return list, nil
+}
@@ -0,0 +1,51 @@
+package ftp
+
+import (
+	"errors"
+	"io"
+)
+
+// Largest file for which SIZE is computed in ASCII or EBCDIC mode.
+const maxTextSize = 64 << 20
+
+var errTextSize = errors.New("file too large to size in this type")
+
+// Return the size of a file as sent in TYPE A or E, given its actual size.
+// Large files are refused rather than read in full.
+func (s *fileSession) textSize(p string, size int64) (int64, error) {
+	if size > maxTextSize {
+		return 0, errTextSize
+	}
+	file, err := s.Open(p)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if s.Type == "E" {
+		return ebcdicSize(file)
+	}
+	return asciiSize(file)
+}
+
+// Return the number of bytes read from r once converted for TYPE A, as is
+// done by Conn.Write.
+func asciiSize(r io.Reader) (int64, error) {
+	var n int64
+	var cr bool
+	buf := make([]byte, 32*1024)
+	for {
+		k, err := r.Read(buf)
+		for _, c := range buf[:k] {
+			if c == '\n' && !cr {
+				n++
+			}
+			cr = c == '\r'
+		}
+		n += int64(k)
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package ftp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path"
+	"strings"
+)
+
+// Prefix and suffix of temporary files used for atomic uploads.
+const (
+	tempPrefix = ".ftp-upload-"
+	tempSuffix = ".part"
+)
+
+// Return a hidden temporary name in the same directory as p. The name does
+// not keep the extension of p, so patterns matching p do not match it.
+func tempName(p string) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return path.Join(path.Dir(p), tempPrefix+hex.EncodeToString(b)+tempSuffix)
+}
+
+// Check if p is a temporary name returned by tempName.
+func isTempName(p string) bool {
+	name := path.Base(p)
+	return strings.HasPrefix(name, tempPrefix) && strings.HasSuffix(name, tempSuffix)
+}
+
+// RemoveTempFiles removes temporary files left by atomic uploads that were
+// interrupted, such as by a crash. This cleans h.FileSystem and the file
+// systems of users, which a UserAuthorizer may return. This should be called
+// at startup, before serving.
+func (h *FileHandler) RemoveTempFiles(users ...*UserSettings) error {
+	if h.FileSystem != nil {
+		if err := removeTempFiles(h.FileSystem); err != nil {
+			return err
+		}
+	}
+	for _, us := range users {
+		if us == nil {
+			continue
+		}
+		fs := us.FileSystem
+		if fs == nil && us.Root != "" {
+			local := &LocalFileSystem{Root: us.Root}
+			defer local.Close()
+			fs = local
+		}
+		if fs == nil {
+			continue
+		}
+		if err := removeTempFiles(fs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove temporary files in fs.
+func removeTempFiles(fs FileSystem) error {
+	var temp []string
+	err := walk(fs, "/", func(p string, fi os.FileInfo) error {
+		if !fi.IsDir() && isTempName(p) {
+			temp = append(temp, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range temp {
+		if err := fs.Remove(p); err != nil && !isNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package ftp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// Descriptor codes of block mode headers, from RFC 959.
+const (
+	blockEOR    = 128 // End of record.
+	blockEOF    = 64  // End of file.
+	blockErrors = 32  // Suspected errors in data.
+	blockMark   = 16  // Data is a restart marker.
+)
+
+// Maximum number of bytes in a block.
+const maxBlock = 1<<16 - 1
+
+// Bytes of data between restart markers sent in block mode.
+const markInterval = 1 << 20
+
+var errNotBlockMode = errors.New("not in block mode")
+
+// Returned by a blockReader at the end of each record, with record structure.
+var errEOR = errors.New("end of record")
+
+// A blockWriter writes data in block mode. Data is buffered until a block is
+// full or flush is called.
+type blockWriter struct {
+	w   *bufio.Writer
+	buf []byte
+}
+
+// Write implements io.Writer.
+func (w *blockWriter) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		k := maxBlock - len(w.buf)
+		if k > len(b) {
+			k = len(b)
+		}
+		w.buf = append(w.buf, b[:k]...)
+		b, n = b[k:], n+k
+		if len(w.buf) == maxBlock {
+			if err := w.flush(0); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// WriteByte implements io.ByteWriter.
+func (w *blockWriter) WriteByte(c byte) error {
+	_, err := w.Write([]byte{c})
+	return err
+}
+
+// Write buffered data as a block with the descriptor desc. This writes an
+// empty block if nothing is buffered and desc is not 0.
+func (w *blockWriter) flush(desc byte) error {
+	if len(w.buf) == 0 && desc == 0 {
+		return nil
+	}
+	if err := w.header(desc, len(w.buf)); err != nil {
+		return err
+	}
+	_, err := w.w.Write(w.buf)
+	w.buf = w.buf[:0]
+	return err
+}
+
+// Write a restart marker, after any buffered data.
+func (w *blockWriter) mark(m string) error {
+	if err := w.flush(0); err != nil {
+		return err
+	}
+	if err := w.header(blockMark, len(m)); err != nil {
+		return err
+	}
+	_, err := w.w.WriteString(m)
+	return err
+}
+
+func (w *blockWriter) header(desc byte, n int) error {
+	h := []byte{desc, 0, 0}
+	binary.BigEndian.PutUint16(h[1:], uint16(n))
+	_, err := w.w.Write(h)
+	return err
+}
+
+// A blockReader reads data in block mode. It returns io.EOF at the end of each
+// file, and reading again continues with the next file.
+type blockReader struct {
+	r       *bufio.Reader
+	records bool  // Whether to return errEOR at the end of records.
+	left    int   // Bytes left in the current block.
+	eor     bool  // Whether the current block ends a record.
+	eof     bool  // Whether the current block ends the file.
+	n       int64 // Bytes of the current file read so far.
+
+	// Function called with each restart marker and the number of bytes of
+	// the file read before it.
+	mark func(m string, n int64)
+}
+
+// Read implements io.Reader.
+func (r *blockReader) Read(b []byte) (n int, err error) {
+	for r.left == 0 {
+		if r.eor {
+			r.eor = false
+			return 0, errEOR
+		}
+		if r.eof {
+			r.eof, r.n = false, 0
+			return 0, io.EOF
+		}
+		h := make([]byte, 3)
+		if _, err := io.ReadFull(r.r, h); err != nil {
+			if err == io.EOF && r.n > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		desc, size := h[0], int(binary.BigEndian.Uint16(h[1:]))
+		if desc&blockMark != 0 {
+			m := make([]byte, size)
+			if _, err := io.ReadFull(r.r, m); err != nil {
+				return 0, io.ErrUnexpectedEOF
+			}
+			if r.mark != nil {
+				r.mark(string(m), r.n)
+			}
+			size = 0
+		}
+		r.left, r.eof = size, desc&blockEOF != 0
+		r.eor = r.records && desc&blockEOR != 0
+	}
+	if len(b) > r.left {
+		b = b[:r.left]
+	}
+	n, err = r.r.Read(b)
+	r.left -= n
+	r.n += int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// A markWriter writes to a Conn in block mode, sending a restart marker every
+// markInterval bytes. Markers are the byte offset in the file.
+type markWriter struct {
+	c   *Conn
+	off int64 // Offset of the next byte written.
+}
+
+// Write implements io.Writer.
+func (w *markWriter) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		k := markInterval - w.off%markInterval
+		if k > int64(len(b)) {
+			k = int64(len(b))
+		}
+		m, err := w.c.Write(b[:k])
+		n, w.off = n+m, w.off+int64(m)
+		if err != nil {
+			return n, err
+		}
+		b = b[k:]
+		if w.off%markInterval == 0 {
+			if err := w.c.Mark(strconv.FormatInt(w.off, 10)); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
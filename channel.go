@@ -28,7 +28,7 @@ func (c *Command) Decode(r *textproto.Reader) error {
 	if err != nil {
 		return err
 	}
-	s := strings.SplitN(line, " ", 2)
+	s := strings.SplitN(stripTelnet(line), " ", 2)
 	if s[0] == "" {
 		return errEmptyCmd
 	}
@@ -39,6 +39,41 @@ func (c *Command) Decode(r *textproto.Reader) error {
 	return nil
 }
 
+// Telnet command bytes that may appear on a control channel.
+const (
+	telnetIAC  = 255 // Interpret as command.
+	telnetSE   = 240 // Lowest command code.
+	telnetWILL = 251 // Lowest option negotiation code.
+)
+
+// Remove Telnet commands from a line, such as the Interrupt Process and Synch
+// sequences that clients send before ABOR. An escaped IAC is kept.
+func stripTelnet(s string) string {
+	if strings.IndexByte(s, telnetIAC) < 0 {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != telnetIAC {
+			b = append(b, s[i])
+			continue
+		}
+		switch {
+		case i+1 >= len(s):
+		case s[i+1] == telnetIAC:
+			b = append(b, telnetIAC)
+			i++
+		case s[i+1] >= telnetWILL:
+			i += 2 // Option negotiation has an option byte.
+		case s[i+1] >= telnetSE:
+			i++
+		}
+		// Otherwise the command byte was sent as urgent data and taken out of
+		// band, so only the IAC remains.
+	}
+	return string(b)
+}
+
 // Args returns the arguments split into tokens.
 func (c *Command) Args() []string {
 	if c.Msg == "" {
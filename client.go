@@ -9,6 +9,7 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"strings"
 )
 
 var errTransferFailed = errors.New("transfer failed")
@@ -20,6 +21,12 @@ type Client struct {
 	Dialer   Dialer   // Dialer for outgoing connections.
 	Listener Listener // Listener for incoming connections.
 	Debug    bool     // Debug prints control channel traffic.
+	Mode     string   // Mode of data transfer, "S", "B" or "Z". Defaults to "S".
+
+	// OnMark, if set, is called with each restart marker received in block
+	// mode and the offset in the file it marks. An interrupted transfer can
+	// be resumed from that offset with Seek.
+	OnMark func(m string, off int64)
 
 	*context
 }
@@ -30,6 +37,9 @@ type context struct {
 	conn  *textproto.Conn
 	ctx   Context
 	cwd   string
+	mode  string   // Mode set on the server.
+	open  *Conn    // Data channel kept open in block mode.
+	feat  []string // Features given by FEAT, once requested.
 }
 
 // DialFTP dials a server.
@@ -58,6 +68,7 @@ func (c *Client) Connect() error {
 		laddr: *conn.LocalAddr().(*net.TCPAddr),
 		raddr: *conn.RemoteAddr().(*net.TCPAddr),
 		conn:  textproto.NewConn(conn),
+		mode:  "S",
 	}
 	if r, err := c.reply(); err != nil {
 		return err
@@ -150,15 +161,83 @@ func (c *Client) Authorize(user, pass string) (bool, error) {
 }
 
 // Data establishes a data channel, preferring to use passive mode, but falling
-// back to active mode if that fails.
+// back to active mode if that fails. In block mode, a data channel left open
+// by the last transfer is used instead.
 func (c *Client) data() (*Conn, error) {
+	if err := c.setMode(); err != nil {
+		return nil, err
+	}
+	if conn := c.open; conn != nil {
+		c.open = nil
+		return conn, nil
+	}
 	conn, err := c.passive()
 	if err != nil {
-		return c.active()
+		if conn, err = c.active(); err != nil {
+			return nil, err
+		}
 	}
+	conn.Mode(c.mode)
 	return conn, nil
 }
 
+// Set the transfer mode on the server, if it has changed. MODE Z is only used
+// if the server supports it, and stream mode is used otherwise.
+func (c *Client) setMode() error {
+	if err := c.connect(); err != nil {
+		return err
+	}
+	mode := c.Mode
+	if mode == "" {
+		mode = "S"
+	}
+	if mode == "Z" {
+		if ok, err := c.supports("MODE Z"); err != nil {
+			return err
+		} else if !ok {
+			mode = "S"
+		}
+	}
+	if mode == c.mode {
+		return nil
+	}
+	r, err := c.exchange("MODE", mode)
+	if err != nil {
+		return err
+	}
+	if !r.Success() {
+		return errors.New("mode not supported")
+	}
+	if c.open != nil {
+		c.open.Close()
+		c.open = nil
+	}
+	c.mode = mode
+	return nil
+}
+
+// Return whether the server lists a feature in reply to FEAT.
+func (c *Client) supports(feat string) (bool, error) {
+	if c.feat == nil {
+		r, err := c.exchange("FEAT", "")
+		if err != nil {
+			return false, err
+		}
+		c.feat = []string{}
+		if r.Code == 211 {
+			for _, line := range r.Lines() {
+				c.feat = append(c.feat, strings.TrimSpace(line))
+			}
+		}
+	}
+	for _, f := range c.feat {
+		if strings.EqualFold(f, feat) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // Passive establishes a data channel by putting the server into passive mode.
 func (c *Client) passive() (*Conn, error) {
 	addr := c.raddr
@@ -295,6 +374,9 @@ func (c *Client) Close() error {
 	if c.conn == nil {
 		return errors.New("not connected")
 	}
+	if c.open != nil {
+		c.open.Close()
+	}
 	err := c.conn.Close()
 	c.context = nil
 	return err
@@ -304,7 +386,10 @@ type clientFile struct {
 	c      *Client
 	path   string
 	conn   *Conn
+	w      io.Writer
+	cmd    string
 	seek   int64
+	eof    bool
 	closed bool
 	prelim bool
 }
@@ -323,9 +408,10 @@ func (f *clientFile) Read(b []byte) (n int, err error) {
 	if err := f.start("RETR", true); err != nil {
 		return 0, err
 	}
-	if n, err := f.conn.Read(b); err != io.EOF {
+	if n, err = f.conn.Read(b); err != io.EOF {
 		return n, err
 	}
+	f.eof = true
 	if err := f.finish(); err != nil {
 		return n, err
 	}
@@ -337,7 +423,7 @@ func (f *clientFile) Write(b []byte) (n int, err error) {
 	if err := f.start("STOR", true); err != nil {
 		return 0, err
 	}
-	return f.conn.Write(b)
+	return f.w.Write(b)
 }
 
 // Readdir implements File.
@@ -369,31 +455,68 @@ func (f *clientFile) start(cmd string, seek bool) error {
 			conn.Close()
 			return err
 		}
-		if !r.Success() {
+		if !r.Intermediate() {
 			conn.Close()
 			return errors.New("could not seek")
 		}
 	}
-	f.conn = conn
+	f.conn, f.w, f.cmd = conn, conn, cmd
+	if f.c.mode == "B" {
+		f.w = &markWriter{conn, f.seek}
+		if cmd == "RETR" && f.c.OnMark != nil {
+			mark, off := f.c.OnMark, f.seek
+			conn.OnMark(func(m string, n int64) { mark(m, off+n) })
+		}
+	}
 	return f.c.command(cmd, f.path)
 }
 
+// Finish the transfer. In block mode, the data channel is kept open for the
+// next transfer if the whole file was sent or received.
 func (f *clientFile) finish() error {
-	if err := f.conn.Close(); err != nil {
-		return err
-	}
+	conn, keep := f.conn, false
 	f.conn = nil
+	if f.c.mode == "B" {
+		conn.OnMark(nil)
+		if f.cmd == "STOR" {
+			keep = conn.EndFile() == nil
+		} else {
+			keep = f.eof
+		}
+	}
+	if !keep {
+		if err := conn.Close(); err != nil {
+			return err
+		}
+	}
 	for {
 		if r, err := f.c.reply(); err != nil {
 			return err
 		} else if r.Success() {
+			if keep {
+				f.c.open = conn
+			}
 			return nil
 		} else if !r.Preliminary() {
+			if keep {
+				conn.Close()
+			}
 			return errors.New("transfer failed")
+		} else if r.Code == 110 {
+			f.c.mark(r.Msg)
 		}
 	}
 }
 
+// Pass a "MARK m = n" reply to OnMark.
+func (c *Client) mark(msg string) {
+	var m string
+	var off int64
+	if _, err := fmt.Sscanf(msg, "MARK %s = %d", &m, &off); err == nil && c.OnMark != nil {
+		c.OnMark(m, off)
+	}
+}
+
 func (f *clientFile) readdir(n int) (fi []os.FileInfo, err error) {
 	for {
 		line, err := f.conn.ReadLine()
@@ -404,6 +527,7 @@ func (f *clientFile) readdir(n int) (fi []os.FileInfo, err error) {
 			fi = append(fi, &stat{name: line})
 		}
 		if err == io.EOF {
+			f.eof = true
 			return fi, nil
 		}
 	}
@@ -2,9 +2,12 @@ package ftp
 
 import (
 	"bufio"
+	"bytes"
+	"compress/zlib"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"strings"
@@ -20,11 +23,23 @@ var ErrInvalidSyntax = errors.New("invalid syntax")
 // transfer type and also performs buffering.
 type Conn struct {
 	w    *bufio.Writer
-	r    *bufio.Reader
+	r    *bufio.Reader // Decoded data.
+	raw  *bufio.Reader // Data as received.
 	typ  string
 	mode string
+	stru string
 	addr net.Addr
 
+	bw   *blockWriter // Block mode encoder.
+	br   *blockReader // Block mode decoder.
+	mark func(m string, n int64)
+
+	zw    *deflateWriter // MODE Z compressor.
+	level int            // MODE Z compression level.
+
+	cp  *CodePage      // Code page for TYPE E.
+	ebc *ebcdicEncoder // TYPE E encoder.
+
 	passive net.Listener
 	active  net.Conn
 	err     error
@@ -44,6 +59,7 @@ func ActiveConn(c net.Conn) *Conn {
 	conn := &Conn{
 		addr:   c.RemoteAddr(),
 		active: c,
+		level:  zlib.DefaultCompression,
 	}
 	conn.m.L = &conn.m
 	return conn
@@ -58,6 +74,7 @@ func PassiveConn(l net.Listener) *Conn {
 	conn := &Conn{
 		addr:    l.Addr(),
 		passive: l,
+		level:   zlib.DefaultCompression,
 	}
 	conn.m.L = &conn.m
 	go conn.listen()
@@ -67,17 +84,75 @@ func PassiveConn(l net.Listener) *Conn {
 // Type sets the transfer type of the connection.
 func (c *Conn) Type(t string) {
 	c.m.Lock()
+	if t != c.typ {
+		c.r = nil
+	}
 	c.typ = t
 	c.m.Unlock()
 }
 
+// Structure sets the file structure of the connection, "F" or "R". With
+// record structure, each line written is sent as a record, and each record
+// read is ended with '\n'.
+func (c *Conn) Structure(s string) {
+	c.m.Lock()
+	if s != c.stru {
+		c.r = nil
+	}
+	c.stru = s
+	c.m.Unlock()
+}
+
+// CodePage sets the code page used for TYPE E. The default is CodePage037.
+func (c *Conn) CodePage(cp *CodePage) {
+	c.m.Lock()
+	if cp != c.cp {
+		c.r, c.ebc = nil, nil
+	}
+	c.cp = cp
+	c.m.Unlock()
+}
+
+// Return the code page for TYPE E.
+func (c *Conn) codePage() *CodePage {
+	if c.cp == nil {
+		return CodePage037
+	}
+	return c.cp
+}
+
 // Mode sets the transfer mode of the connection.
 func (c *Conn) Mode(m string) {
 	c.m.Lock()
+	if m != c.mode {
+		c.r, c.bw, c.br, c.zw = nil, nil, nil, nil
+	}
 	c.mode = m
 	c.m.Unlock()
 }
 
+// Level sets the compression level of MODE Z, as for compress/zlib. This
+// must be called before data is written.
+func (c *Conn) Level(n int) {
+	c.m.Lock()
+	if n != c.level {
+		c.zw = nil
+	}
+	c.level = n
+	c.m.Unlock()
+}
+
+// OnMark sets a function to call with each restart marker read in block mode.
+// It is given the marker and the number of bytes of the file read before it.
+func (c *Conn) OnMark(fn func(m string, n int64)) {
+	c.m.Lock()
+	c.mark = fn
+	if c.br != nil {
+		c.br.mark = fn
+	}
+	c.m.Unlock()
+}
+
 func (c *Conn) listen() {
 	if c.active != nil {
 		panic("active connection already established")
@@ -148,8 +223,28 @@ func (c *Conn) reader() (*bufio.Reader, error) {
 		c.m.Unlock()
 		return nil, err
 	}
+	if c.raw == nil {
+		c.raw = bufio.NewReader(c.active)
+	}
 	if c.r == nil {
-		c.r = bufio.NewReader(c.active)
+		// Decode the mode, then the type and structure.
+		c.r = c.raw
+		switch c.mode {
+		case "B":
+			c.br = &blockReader{r: c.raw, records: c.stru == "R", mark: c.mark}
+			c.r = bufio.NewReader(c.br)
+		case "Z":
+			c.r = bufio.NewReader(&inflateReader{r: c.raw})
+		}
+		escape := c.stru == "R" && c.mode != "B"
+		if c.typ == "A" || c.typ == "E" || c.stru == "R" {
+			c.r = bufio.NewReader(&textReader{
+				r:      c.r,
+				typ:    c.typ,
+				cp:     c.codePage(),
+				escape: escape,
+			})
+		}
 	}
 	r := c.r
 	c.m.Unlock()
@@ -158,7 +253,10 @@ func (c *Conn) reader() (*bufio.Reader, error) {
 }
 
 // Read implements io.Reader. If a connection has not been established, this
-// waits for a connection.
+// waits for a connection. In ASCII mode, CRLF is converted to LF, and in
+// EBCDIC mode, data is converted to UTF-8. In block
+// mode, this returns io.EOF at the end of each file, and reading again
+// continues with the next file.
 func (c *Conn) Read(b []byte) (n int, err error) {
 	r, err := c.reader()
 	if err != nil {
@@ -186,30 +284,162 @@ func (c *Conn) ReadLine() (line string, err error) {
 	}
 }
 
-// Write implements io.Writer. If a connection has not been established, this
-// waits for a connection.
-func (c *Conn) Write(b []byte) (n int, err error) {
+// Wait for the connection and return the writer for data.
+func (c *Conn) writer() (byteWriter, error) {
 	c.m.Lock()
+	defer c.m.Unlock()
 	for c.active == nil && c.err == nil {
 		c.m.Wait()
 	}
 	if err := c.err; err != nil {
-		c.m.Unlock()
-		return 0, err
+		return nil, err
 	}
 	if c.w == nil {
 		c.w = bufio.NewWriter(c.active)
 	}
-	w, typ := c.w, c.typ
+	switch c.mode {
+	case "B":
+		if c.bw == nil {
+			c.bw = &blockWriter{w: c.w}
+		}
+		return c.bw, nil
+	case "Z":
+		if c.zw == nil {
+			zw, err := newDeflateWriter(c.w, c.level)
+			if err != nil {
+				return nil, err
+			}
+			c.zw = zw
+		}
+		return c.zw, nil
+	}
+	return c.w, nil
+}
+
+// A byteWriter is a writer that can write single bytes.
+type byteWriter interface {
+	io.Writer
+	io.ByteWriter
+}
+
+// Write implements io.Writer. If a connection has not been established, this
+// waits for a connection. In ASCII mode, LF is converted to CRLF, and in
+// EBCDIC mode, UTF-8 is converted to the code page.
+func (c *Conn) Write(b []byte) (n int, err error) {
+	w, err := c.writer()
+	if err != nil {
+		return 0, err
+	}
+	c.m.Lock()
+	typ, stru, mode := c.typ, c.stru, c.mode
 	c.m.Unlock()
 
-	if typ == "A" {
+	if stru != "R" {
+		return c.encode(w, typ, b)
+	}
+	if mode != "B" {
+		w = &escapeWriter{w}
+	}
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			k, err := c.encode(w, typ, b)
+			return n + k, err
+		}
+		k, err := c.encode(w, typ, b[:i])
+		if n += k; err != nil {
+			return n, err
+		}
+		if err := c.EndRecord(); err != nil {
+			return n, err
+		}
+		b, n = b[i+1:], n+1
+	}
+	return n, nil
+}
+
+// Write b to w, converted for the transfer type.
+func (c *Conn) encode(w byteWriter, typ string, b []byte) (n int, err error) {
+	switch typ {
+	case "A":
 		return c.writeASCII(w, b)
+	case "E":
+		c.m.Lock()
+		if c.ebc == nil {
+			c.ebc = &ebcdicEncoder{enc: c.codePage().encoding()}
+		}
+		e := c.ebc
+		c.m.Unlock()
+		return e.write(w, b)
 	}
 	return w.Write(b)
 }
 
-func (c *Conn) writeASCII(w *bufio.Writer, b []byte) (n int, err error) {
+// Return the block mode encoder, or an error if not in block mode.
+func (c *Conn) block() (*blockWriter, error) {
+	w, err := c.writer()
+	if err != nil {
+		return nil, err
+	}
+	bw, ok := w.(*blockWriter)
+	if !ok {
+		return nil, errNotBlockMode
+	}
+	return bw, nil
+}
+
+// EndFile marks the end of a file written in block mode and flushes the
+// connection, which remains open for another transfer. In stream mode, the
+// end of a file is marked by closing the connection instead.
+func (c *Conn) EndFile() error {
+	w, err := c.block()
+	if err != nil {
+		return err
+	}
+	c.m.Lock()
+	e := c.ebc
+	c.m.Unlock()
+	if e != nil {
+		// An incomplete character does not continue into the next file.
+		if err := e.flush(w); err != nil {
+			return err
+		}
+	}
+	c.cr = false
+	if err := w.flush(blockEOF); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+// EndRecord marks the end of a record. In block mode, this ends a block with
+// EOR. In stream mode, this writes the EOR escape code, so it should only be
+// used with record structure.
+func (c *Conn) EndRecord() error {
+	w, err := c.writer()
+	if err != nil {
+		return err
+	}
+	c.cr = false
+	if bw, ok := w.(*blockWriter); ok {
+		return bw.flush(blockEOR)
+	}
+	_, err = w.Write([]byte{recordEscape, recordEOR})
+	return err
+}
+
+// Mark writes a restart marker in block mode. The marker should be printable,
+// and can be given to REST to resume the transfer after the data written so
+// far.
+func (c *Conn) Mark(m string) error {
+	w, err := c.block()
+	if err != nil {
+		return err
+	}
+	return w.mark(m)
+}
+
+func (c *Conn) writeASCII(w byteWriter, b []byte) (n int, err error) {
 	for _, b := range b {
 		if !c.cr && b == '\n' {
 			if err = w.WriteByte('\r'); err != nil {
@@ -226,19 +456,57 @@ func (c *Conn) writeASCII(w *bufio.Writer, b []byte) (n int, err error) {
 	return
 }
 
-// Flush any buffered data.
+// Flush any buffered data. In block mode, this sends buffered data as a block.
 func (c *Conn) Flush() error {
 	c.m.Lock()
-	w := c.w
+	w, bw, zw := c.w, c.bw, c.zw
 	c.m.Unlock()
+	if bw != nil {
+		if err := bw.flush(0); err != nil {
+			return err
+		}
+	}
+	if zw != nil {
+		if err := zw.flush(); err != nil {
+			return err
+		}
+	}
 	if w != nil && w.Buffered() > 0 {
 		return w.Flush()
 	}
 	return nil
 }
 
-// Close flushes and closes the connection.
+// Close flushes and closes the connection. If the connection was not read
+// from, then with record structure in stream mode, this marks the end of the
+// file, and in MODE Z, this ends the compressed stream.
 func (c *Conn) Close() (err error) {
+	c.m.Lock()
+	e, written := c.ebc, c.w != nil
+	// An established connection that was not read from is sending, so it
+	// marks the end of the file and ends its compressed stream even if
+	// nothing was written.
+	sending := c.active != nil && c.err == nil && c.raw == nil
+	eof := sending && c.stru == "R" && c.mode != "B"
+	c.m.Unlock()
+	if written || sending {
+		// The connection was established, so this does not wait.
+		if w, err := c.writer(); err == nil {
+			if e != nil {
+				e.flush(w)
+			}
+			if eof {
+				w.Write([]byte{recordEscape, recordEOF})
+			}
+		}
+	}
+	c.m.Lock()
+	zw := c.zw
+	c.zw = nil
+	c.m.Unlock()
+	if zw != nil {
+		zw.close()
+	}
 	if err := c.Flush(); err != nil {
 	}
 	c.m.Lock()
@@ -251,6 +519,17 @@ func (c *Conn) Close() (err error) {
 	return err
 }
 
+// Abort closes the connection without flushing buffered data. This may be
+// called concurrently with Read and Write to interrupt them.
+func (c *Conn) Abort() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.active != nil {
+		return c.active.Close()
+	}
+	return c.passive.Close()
+}
+
 // LocalAddr waits for a connection, then calls LocalAddr on it.
 func (c *Conn) LocalAddr() net.Addr {
 	conn, err := c.accept()
@@ -9,6 +9,7 @@ type Context struct {
 	Dir      string // Dir is the working directory.
 	Mode     string // Mode of data transfer.
 	Type     string // Type of data channel.
+	Stru     string // Structure of data, "F" or "R".
 	Data     *Conn  // Data channel connection.
 }
 
@@ -0,0 +1,59 @@
+package ftp
+
+import (
+	"bufio"
+	"compress/zlib"
+	"io"
+)
+
+// A deflateWriter compresses data written in MODE Z. Data is buffered before
+// compression so that single bytes can be written cheaply.
+type deflateWriter struct {
+	*bufio.Writer
+	z *zlib.Writer
+}
+
+func newDeflateWriter(w io.Writer, level int) (*deflateWriter, error) {
+	z, err := zlib.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, err
+	}
+	return &deflateWriter{bufio.NewWriter(z), z}, nil
+}
+
+// Compress buffered data and flush it to the underlying writer.
+func (w *deflateWriter) flush() error {
+	if err := w.Writer.Flush(); err != nil {
+		return err
+	}
+	return w.z.Flush()
+}
+
+// Compress buffered data and end the compressed stream.
+func (w *deflateWriter) close() error {
+	if err := w.Writer.Flush(); err != nil {
+		return err
+	}
+	return w.z.Close()
+}
+
+// An inflateReader decompresses data read in MODE Z. The zlib header is not
+// read until the first call to Read.
+type inflateReader struct {
+	r *bufio.Reader
+	z io.ReadCloser
+}
+
+// Read implements io.Reader.
+func (r *inflateReader) Read(b []byte) (n int, err error) {
+	if r.z == nil {
+		// Nothing at all is sent for an empty file by some peers.
+		if _, err := r.r.Peek(1); err != nil {
+			return 0, err
+		}
+		if r.z, err = zlib.NewReader(r.r); err != nil {
+			return 0, err
+		}
+	}
+	return r.z.Read(b)
+}
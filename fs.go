@@ -4,6 +4,10 @@ import (
 	"io"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 // FileSystem is the interface expected by a FileHandler. This type is intended
@@ -19,6 +23,65 @@ type FileSystem interface {
 	Stat(path string) (os.FileInfo, error) // Stat a file or directory.
 }
 
+// OpenFileFS is a FileSystem that can open files with flags and permissions
+// like os.OpenFile.
+type OpenFileFS interface {
+	FileSystem
+	OpenFile(path string, flag int, perm os.FileMode) (File, error)
+}
+
+// ChmodFS is a FileSystem that can change permissions like os.Chmod.
+type ChmodFS interface {
+	FileSystem
+	Chmod(path string, mode os.FileMode) error
+}
+
+// SymlinkFS is a FileSystem that can create symbolic links like os.Symlink.
+// An absolute oldname is a path within the FileSystem.
+type SymlinkFS interface {
+	FileSystem
+	Symlink(oldname, newname string) error
+}
+
+// ChtimesFS is a FileSystem that can change access and modification times
+// like os.Chtimes. A zero time leaves the corresponding time unchanged.
+type ChtimesFS interface {
+	FileSystem
+	Chtimes(path string, atime, mtime time.Time) error
+}
+
+// LstatFS is a FileSystem that can stat a symbolic link itself like os.Lstat.
+type LstatFS interface {
+	FileSystem
+	Lstat(path string) (os.FileInfo, error)
+}
+
+// ReadlinkFS is a FileSystem that can read symbolic links like os.Readlink.
+type ReadlinkFS interface {
+	FileSystem
+	Readlink(path string) (string, error)
+}
+
+// ChownFS is a FileSystem that can change owners like os.Chown. An id of -1
+// leaves the corresponding owner unchanged.
+type ChownFS interface {
+	FileSystem
+	Chown(path string, uid, gid int) error
+}
+
+// TruncateFS is a FileSystem that can change the size of files like
+// os.Truncate.
+type TruncateFS interface {
+	FileSystem
+	Truncate(path string, size int64) error
+}
+
+// CreateTimeFS is a FileSystem that can change creation times.
+type CreateTimeFS interface {
+	FileSystem
+	SetCreateTime(path string, ctime time.Time) error
+}
+
 // File is the interface returned by certain FileSystem methods.
 type File interface {
 	io.Reader
@@ -31,45 +94,119 @@ type File interface {
 }
 
 // LocalFileSystem is a FileSystem implementation that calls os package
-// functions.
+// functions. Every operation is confined to Root, even through symbolic links.
+// On Go 1.25 and later, Root is opened with os.Root on first use and held open
+// until Close. It is opened again if Root changes. A LocalFileSystem should not
+// be copied after first use.
 type LocalFileSystem struct {
-	Root string // Root of the file system, or current directory if "".
+	Root  string     // Root of the file system, or current directory if "".
+	Links LinkPolicy // Links is which symbolic links are followed.
+
+	mu     sync.Mutex
+	root   *localRoot // Root, once opened.
+	opened string     // Root when root was opened.
 }
 
+// A LinkPolicy is which symbolic links a LocalFileSystem follows. Links that
+// resolve outside Root are never followed.
+type LinkPolicy int
+
+const (
+	LinksInRoot LinkPolicy = iota // Follow links that stay within Root.
+	LinksNone                     // Do not follow links.
+)
+
+var (
+	_ OpenFileFS = (*LocalFileSystem)(nil)
+	_ ChmodFS    = (*LocalFileSystem)(nil)
+	_ SymlinkFS  = (*LocalFileSystem)(nil)
+	_ ChtimesFS  = (*LocalFileSystem)(nil)
+	_ LstatFS    = (*LocalFileSystem)(nil)
+	_ ReadlinkFS = (*LocalFileSystem)(nil)
+	_ ChownFS    = (*LocalFileSystem)(nil)
+	_ TruncateFS = (*LocalFileSystem)(nil)
+)
+
 // Create implements FileSystem.
 func (f *LocalFileSystem) Create(path string) (File, error) {
-	return os.Create(f.path(path))
+	return f.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 }
 
 // Open implements FileSystem.
 func (f *LocalFileSystem) Open(path string) (File, error) {
-	return os.Open(f.path(path))
+	return f.OpenFile(path, os.O_RDONLY, 0)
 }
 
-// Stat implements FileSystem.
-func (f *LocalFileSystem) Stat(path string) (os.FileInfo, error) {
-	return os.Stat(f.path(path))
-}
-
-// Mkdir implements FileSystem.
-func (f *LocalFileSystem) Mkdir(path string) error {
-	return os.Mkdir(f.path(path), 0755)
+// Symlink implements SymlinkFS. An absolute oldname is made relative to the
+// directory of newname, so that the link resolves within Root. A relative
+// oldname that leads out of Root is refused.
+func (f *LocalFileSystem) Symlink(oldname, newname string) error {
+	newname = path.Join("/", newname)
+	if path.IsAbs(oldname) {
+		rel, err := filepath.Rel(path.Dir(newname), oldname)
+		if err != nil {
+			return err
+		}
+		oldname = filepath.ToSlash(rel)
+	} else if escapes(path.Dir(newname), oldname) {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: os.ErrPermission}
+	}
+	return f.symlink(filepath.FromSlash(oldname), newname)
 }
 
-// Remove implements FileSystem.
-func (f *LocalFileSystem) Remove(path string) error {
-	return os.Remove(f.path(path))
+// Truncate implements TruncateFS.
+func (f *LocalFileSystem) Truncate(path string, size int64) error {
+	file, err := f.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	err = file.(*os.File).Truncate(size)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
-// Rename implements FileSystem.
-func (f *LocalFileSystem) Rename(old, new string) error {
-	return os.Rename(f.path(old), f.path(new))
+// Whether the relative path p leads out of the root from dir.
+func escapes(dir, p string) bool {
+	depth := len(splitPath(dir))
+	for _, name := range strings.Split(p, "/") {
+		switch name {
+		case "", ".":
+		case "..":
+			if depth--; depth < 0 {
+				return true
+			}
+		default:
+			depth++
+		}
+	}
+	return false
 }
 
-func (f *LocalFileSystem) path(p string) string {
-	p = path.Join("/", p) // Prevent directory traversal.
-	if f.Root == "" {
-		return path.Join(".", p)
+// Walk calls fn for every file and directory under p, not including p.
+// Directories that cannot be read due to permissions are skipped.
+func walk(fs FileSystem, p string, fn func(p string, fi os.FileInfo) error) error {
+	dir, err := fs.Open(p)
+	if err != nil {
+		return err
+	}
+	list, err := dir.Readdir(0)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+	for _, fi := range list {
+		fp := path.Join(p, fi.Name())
+		if err := fn(fp, fi); err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			continue
+		}
+		if err := walk(fs, fp, fn); err != nil && !isPermission(err) {
+			return err
+		}
 	}
-	return path.Join(f.Root, p)
+	return nil
 }
@@ -0,0 +1,159 @@
+//go:build !go1.25
+
+package ftp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Before Go 1.25, os.Root cannot do every operation, so paths are resolved
+// within Root here instead. Links are checked as a path is resolved, but a
+// link changed between the check and its use is not confined.
+type localRoot struct{}
+
+// OpenFile implements OpenFileFS.
+func (f *LocalFileSystem) OpenFile(path string, flag int, perm os.FileMode) (File, error) {
+	p, err := f.path(path, true)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(p, flag, perm)
+}
+
+// Chmod implements ChmodFS.
+func (f *LocalFileSystem) Chmod(path string, mode os.FileMode) error {
+	p, err := f.path(path, true)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(p, mode)
+}
+
+// Make a link at newname to oldname, which is in OS form.
+func (f *LocalFileSystem) symlink(oldname, newname string) error {
+	p, err := f.path(newname, false)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(oldname, p)
+}
+
+// Chtimes implements ChtimesFS.
+func (f *LocalFileSystem) Chtimes(path string, atime, mtime time.Time) error {
+	p, err := f.path(path, true)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(p, atime, mtime)
+}
+
+// Readlink implements ReadlinkFS.
+func (f *LocalFileSystem) Readlink(path string) (string, error) {
+	p, err := f.path(path, false)
+	if err != nil {
+		return "", err
+	}
+	target, err := os.Readlink(p)
+	return filepath.ToSlash(target), err
+}
+
+// Chown implements ChownFS.
+func (f *LocalFileSystem) Chown(path string, uid, gid int) error {
+	p, err := f.path(path, true)
+	if err != nil {
+		return err
+	}
+	return os.Chown(p, uid, gid)
+}
+
+// Lstat implements LstatFS.
+func (f *LocalFileSystem) Lstat(path string) (os.FileInfo, error) {
+	p, err := f.path(path, false)
+	if err != nil {
+		return nil, err
+	}
+	return os.Lstat(p)
+}
+
+// Stat implements FileSystem.
+func (f *LocalFileSystem) Stat(path string) (os.FileInfo, error) {
+	p, err := f.path(path, true)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+// Mkdir implements FileSystem.
+func (f *LocalFileSystem) Mkdir(path string) error {
+	p, err := f.path(path, false)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(p, 0755)
+}
+
+// Remove implements FileSystem.
+func (f *LocalFileSystem) Remove(path string) error {
+	p, err := f.path(path, false)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+// Rename implements FileSystem.
+func (f *LocalFileSystem) Rename(old, new string) error {
+	oldp, err := f.path(old, false)
+	if err != nil {
+		return err
+	}
+	newp, err := f.path(new, false)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldp, newp)
+}
+
+// Close implements io.Closer. Nothing is held open before Go 1.25.
+func (f *LocalFileSystem) Close() error {
+	return nil
+}
+
+// Return the OS path of p within Root. Links in p are resolved, and fail if
+// they lead out of Root or if Links is LinksNone. The last element of p is
+// only resolved if follow is set.
+func (f *LocalFileSystem) path(p string, follow bool) (string, error) {
+	root := f.Root
+	if root == "" {
+		root = "."
+	}
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	dir := root
+	names := splitPath(p)
+	for i, name := range names {
+		next := filepath.Join(dir, name)
+		fi, err := os.Lstat(next)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 || i == len(names)-1 && !follow {
+			dir = next
+			continue
+		}
+		if f.Links == LinksNone {
+			return "", &os.PathError{Op: "follow", Path: p, Err: os.ErrPermission}
+		}
+		if dir, err = filepath.EvalSymlinks(next); err != nil {
+			return "", err
+		}
+		rel, err := filepath.Rel(root, dir)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", &os.PathError{Op: "follow", Path: p, Err: os.ErrPermission}
+		}
+	}
+	return dir, nil
+}
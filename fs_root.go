@@ -0,0 +1,191 @@
+//go:build go1.25
+
+package ftp
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// The opened Root of a LocalFileSystem.
+type localRoot = os.Root
+
+// OpenFile implements OpenFileFS.
+func (f *LocalFileSystem) OpenFile(path string, flag int, perm os.FileMode) (File, error) {
+	root, name, err := f.open(path, true)
+	if err != nil {
+		return nil, err
+	}
+	return root.OpenFile(name, flag, perm)
+}
+
+// Chmod implements ChmodFS.
+func (f *LocalFileSystem) Chmod(path string, mode os.FileMode) error {
+	root, name, err := f.open(path, true)
+	if err != nil {
+		return err
+	}
+	return root.Chmod(name, mode)
+}
+
+// Make a link at newname to oldname, which is in OS form.
+func (f *LocalFileSystem) symlink(oldname, newname string) error {
+	root, name, err := f.open(newname, false)
+	if err != nil {
+		return err
+	}
+	return root.Symlink(oldname, name)
+}
+
+// Chtimes implements ChtimesFS.
+func (f *LocalFileSystem) Chtimes(path string, atime, mtime time.Time) error {
+	root, name, err := f.open(path, true)
+	if err != nil {
+		return err
+	}
+	return root.Chtimes(name, atime, mtime)
+}
+
+// Readlink implements ReadlinkFS.
+func (f *LocalFileSystem) Readlink(path string) (string, error) {
+	root, name, err := f.open(path, false)
+	if err != nil {
+		return "", err
+	}
+	target, err := root.Readlink(name)
+	return filepath.ToSlash(target), err
+}
+
+// Chown implements ChownFS.
+func (f *LocalFileSystem) Chown(path string, uid, gid int) error {
+	root, name, err := f.open(path, true)
+	if err != nil {
+		return err
+	}
+	return root.Chown(name, uid, gid)
+}
+
+// Lstat implements LstatFS.
+func (f *LocalFileSystem) Lstat(path string) (os.FileInfo, error) {
+	root, name, err := f.open(path, false)
+	if err != nil {
+		return nil, err
+	}
+	return root.Lstat(name)
+}
+
+// Stat implements FileSystem.
+func (f *LocalFileSystem) Stat(path string) (os.FileInfo, error) {
+	root, name, err := f.open(path, true)
+	if err != nil {
+		return nil, err
+	}
+	return root.Stat(name)
+}
+
+// Mkdir implements FileSystem.
+func (f *LocalFileSystem) Mkdir(path string) error {
+	root, name, err := f.open(path, false)
+	if err != nil {
+		return err
+	}
+	return root.Mkdir(name, 0755)
+}
+
+// Remove implements FileSystem.
+func (f *LocalFileSystem) Remove(path string) error {
+	root, name, err := f.open(path, false)
+	if err != nil {
+		return err
+	}
+	return root.Remove(name)
+}
+
+// Rename implements FileSystem.
+func (f *LocalFileSystem) Rename(old, new string) error {
+	root, oldname, err := f.open(old, false)
+	if err != nil {
+		return err
+	}
+	if err := f.checkLinks(root, new, false); err != nil {
+		return err
+	}
+	return root.Rename(oldname, f.name(new))
+}
+
+// Return Root and the name of p within it, opening Root if it has not been
+// opened or has changed. If Links is LinksNone, this fails if p passes
+// through a link, or is one and follow is set.
+func (f *LocalFileSystem) open(p string, follow bool) (*os.Root, string, error) {
+	f.mu.Lock()
+	if f.root != nil && f.opened != f.Root {
+		f.root.Close()
+		f.root = nil
+	}
+	if f.root == nil {
+		dir := f.Root
+		if dir == "" {
+			dir = "."
+		}
+		root, err := os.OpenRoot(dir)
+		if err != nil {
+			f.mu.Unlock()
+			return nil, "", err
+		}
+		f.root, f.opened = root, f.Root
+	}
+	root := f.root
+	f.mu.Unlock()
+	if err := f.checkLinks(root, p, follow); err != nil {
+		return nil, "", err
+	}
+	return root, f.name(p), nil
+}
+
+// Close closes Root if it is open. It is opened again if the LocalFileSystem
+// is used after, so Close should not be called while it is in use.
+func (f *LocalFileSystem) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.root == nil {
+		return nil
+	}
+	err := f.root.Close()
+	f.root = nil
+	return err
+}
+
+// Check that p does not pass through a link, if Links is LinksNone. A link
+// created after the check is still confined to Root.
+func (f *LocalFileSystem) checkLinks(root *os.Root, p string, follow bool) error {
+	if f.Links != LinksNone {
+		return nil
+	}
+	p = path.Join("/", p)
+	for i := 1; i <= len(p); i++ {
+		if i < len(p) && p[i] != '/' || i == len(p) && !follow {
+			continue
+		}
+		fi, err := root.Lstat(f.name(p[:i]))
+		if isNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return &os.PathError{Op: "follow", Path: p, Err: os.ErrPermission}
+		}
+	}
+	return nil
+}
+
+// Return the name of p relative to Root.
+func (f *LocalFileSystem) name(p string) string {
+	p = path.Join("/", p) // Prevent directory traversal.
+	if p == "/" {
+		return "."
+	}
+	return filepath.FromSlash(p[1:])
+}
@@ -1,7 +1,12 @@
 package ftp
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/md5"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
@@ -11,13 +16,19 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"math/big"
+	"net"
+	"net/textproto"
 	"os"
 	"path"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
 	"time"
 )
 
@@ -74,6 +85,1308 @@ func TestFTP(t *testing.T) {
 	}
 }
 
+func TestBlockMode(t *testing.T) {
+	a, b := net.Pipe()
+	w, r := ActiveConn(a), ActiveConn(b)
+	w.Mode("B")
+	r.Mode("B")
+	var marks []string
+	r.OnMark(func(m string, n int64) {
+		marks = append(marks, fmt.Sprintf("%s=%d", m, n))
+	})
+	go func() {
+		w.Write([]byte("hello, "))
+		w.Mark("7")
+		w.Write([]byte("world"))
+		w.EndFile()
+		w.EndFile()
+		w.Write(bytes.Repeat([]byte("x"), 70000))
+		w.EndFile()
+		w.Close()
+	}()
+
+	for i, want := range []string{"hello, world", "", strings.Repeat("x", 70000)} {
+		if b, err := ioutil.ReadAll(r); err != nil {
+			t.Fatal(err)
+		} else if string(b) != want {
+			t.Errorf("file %d: got %d bytes, want %d", i, len(b), len(want))
+		}
+	}
+	if len(marks) != 1 || marks[0] != "7=7" {
+		t.Error("bad marks:", marks)
+	}
+	if _, err := r.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("expected EOF, got", err)
+	}
+}
+
+func TestBlockModeClient(t *testing.T) {
+	s := &Server{
+		Addr: "localhost:0",
+		Handler: &FileHandler{
+			Authorizer: new(testAuth),
+			FileSystem: &LocalFileSystem{Root: t.TempDir()},
+		},
+	}
+	li, err := s.ListenAndServe(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer li.Close()
+
+	c := &Client{Addr: li.Addr().String(), Mode: "B"}
+	defer c.Close()
+	if ok, err := c.Authorize("foo", "bar"); !ok || err != nil {
+		t.Fatal("login failed:", err)
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), markInterval/4)
+	f, _ := c.Create("big")
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	open := c.open
+	if open == nil {
+		t.Fatal("data connection was closed")
+	}
+	for i := 0; i < 2; i++ {
+		f, _ = c.Open("big")
+		if b, err := ioutil.ReadAll(f); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(b, data) {
+			t.Fatal("bad data:", len(b))
+		}
+		f.Close()
+		if c.open != open {
+			t.Fatal("data connection was not reused")
+		}
+	}
+}
+
+func TestClientMarks(t *testing.T) {
+	s := &Server{
+		Addr: "localhost:0",
+		Handler: &FileHandler{
+			Authorizer: new(testAuth),
+			FileSystem: &LocalFileSystem{Root: t.TempDir()},
+		},
+	}
+	li, err := s.ListenAndServe(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer li.Close()
+
+	var marks []int64
+	c := &Client{Addr: li.Addr().String(), Mode: "B"}
+	c.OnMark = func(m string, off int64) {
+		if m != strconv.FormatInt(off, 10) {
+			t.Errorf("marker %q at %d", m, off)
+		}
+		marks = append(marks, off)
+	}
+	defer c.Close()
+	if ok, err := c.Authorize("foo", "bar"); !ok || err != nil {
+		t.Fatal("login failed:", err)
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), markInterval/4)
+	f, _ := c.Create("big")
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(marks) != 2 || marks[0] != markInterval || marks[1] != 2*markInterval {
+		t.Fatal("bad upload marks:", marks)
+	}
+
+	// Stop reading after the first marker, then resume from it.
+	marks = nil
+	f, _ = c.Open("big")
+	var got []byte
+	b := make([]byte, 32<<10)
+	for len(marks) == 0 {
+		n, err := f.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, b[:n]...)
+	}
+	f.Close()
+	off := marks[0]
+	if off != markInterval || int64(len(got)) < off {
+		t.Fatal("bad download mark:", off, len(got))
+	}
+	f, _ = c.Open("big")
+	f.Seek(off, io.SeekStart)
+	rest, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if !bytes.Equal(append(got[:off], rest...), data) {
+		t.Fatal("bad resumed data:", len(rest))
+	}
+	if len(marks) != 2 || marks[1] != 2*markInterval {
+		t.Fatal("bad resumed marks:", marks)
+	}
+}
+
+func TestModeZ(t *testing.T) {
+	dir := t.TempDir()
+	h := &FileHandler{
+		Authorizer: new(testAuth),
+		FileSystem: &LocalFileSystem{Root: dir},
+	}
+	s := &Server{Addr: "localhost:0", Handler: h}
+	li, err := s.ListenAndServe(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer li.Close()
+
+	c := &Client{Addr: li.Addr().String(), Mode: "Z"}
+	defer c.Close()
+	if ok, err := c.Authorize("foo", "bar"); !ok || err != nil {
+		t.Fatal("login failed:", err)
+	}
+	data := bytes.Repeat([]byte("all work and no play\n"), 10000)
+	f, _ := c.Create("dull.txt")
+	f.Write(data)
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if c.mode != "Z" {
+		t.Fatal("MODE Z was not used")
+	}
+	f, _ = c.Open("dull.txt")
+	if b, err := ioutil.ReadAll(f); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(b, data) {
+		t.Fatal("bad data:", len(b))
+	}
+	if b, _ := ioutil.ReadFile(path.Join(dir, "dull.txt")); !bytes.Equal(b, data) {
+		t.Fatal("bad file:", len(b))
+	}
+
+	tc := dialTest(t, h)
+	if r := tc.cmd("OPTS MODE Z LEVEL 10"); r.Code != 501 {
+		t.Error("bad reply:", r.Code, r.Msg)
+	}
+	if r := tc.cmd("OPTS MODE Z LEVEL 9"); r.Code != 200 {
+		t.Error("bad reply:", r.Code, r.Msg)
+	}
+	tc.cmd("MODE Z")
+	_, got := tc.transfer("RETR dull.txt", "")
+	if len(got) >= len(data)/10 {
+		t.Error("data was not compressed:", len(got))
+	}
+
+	// A level set once the data channel is open applies to it.
+	conn, r := tc.open(0, "OPTS MODE Z LEVEL 0")
+	defer conn.Close()
+	if r.Code != 200 {
+		t.Fatal("bad reply:", r.Code, r.Msg)
+	} else if r := tc.cmd("RETR dull.txt"); r.Code != 150 {
+		t.Fatal("bad reply:", r.Code, r.Msg)
+	}
+	b, _ := ioutil.ReadAll(conn)
+	if r := tc.reply(); r.Code != 226 {
+		t.Error("bad reply:", r.Code, r.Msg)
+	}
+	if len(b) < len(data) {
+		t.Error("data was compressed:", len(b))
+	}
+
+	// An empty file is sent as an empty compressed stream.
+	ioutil.WriteFile(path.Join(dir, "empty.txt"), nil, 0644)
+	_, got = tc.transfer("RETR empty.txt", "")
+	if z, err := zlib.NewReader(strings.NewReader(got)); err != nil {
+		t.Error("bad stream:", err)
+	} else if b, err := ioutil.ReadAll(z); err != nil || len(b) != 0 {
+		t.Errorf("bad data: %q %v", b, err)
+	}
+}
+
+func TestASCII(t *testing.T) {
+	a, b := net.Pipe()
+	r := ActiveConn(b)
+	r.Type("A")
+	go func() {
+		// Split a CRLF across writes.
+		io.WriteString(a, "a\r\nb\r")
+		io.WriteString(a, "\nc\rd\r\n\r")
+		a.Close()
+	}()
+	if got, err := ioutil.ReadAll(r); err != nil {
+		t.Fatal(err)
+	} else if string(got) != "a\nb\nc\rd\n\r" {
+		t.Errorf("bad data: %q", got)
+	}
+
+	dir := t.TempDir()
+	ioutil.WriteFile(path.Join(dir, "text"), []byte("a\nb\r\nc"), 0644)
+	c := dialTest(t, &FileHandler{
+		FileSystem: &LocalFileSystem{Root: dir},
+	})
+	if r := c.cmd("SIZE text"); r.Msg != "6" {
+		t.Error("bad binary size:", r.Code, r.Msg)
+	}
+	c.cmd("TYPE A")
+	if r := c.cmd("SIZE text"); r.Msg != "7" {
+		t.Error("bad ASCII size:", r.Code, r.Msg)
+	}
+	c.transfer("STOR upload", "x\r\ny\r\n")
+	if b, _ := ioutil.ReadFile(path.Join(dir, "upload")); string(b) != "x\ny\n" {
+		t.Errorf("bad upload: %q", b)
+	}
+}
+
+func TestEBCDIC(t *testing.T) {
+	a, b := net.Pipe()
+	w, r := ActiveConn(a), ActiveConn(b)
+	w.Type("E")
+	go func(w *Conn) {
+		// Split a character across writes.
+		w.Write([]byte("Hello\nw\xc3"))
+		w.Write([]byte("\xb6rld\u20ac"))
+		w.Close()
+	}(w)
+	raw, _ := ioutil.ReadAll(r)
+	if want := "\xc8\x85\x93\x93\x96\x15\xa6\xcc\x99\x93\x84\x3f"; string(raw) != want {
+		t.Errorf("bad encoding: %x", raw)
+	}
+
+	// In block mode, each file ends with its incomplete character.
+	a, b = net.Pipe()
+	w, r = ActiveConn(a), ActiveConn(b)
+	for _, c := range []*Conn{w, r} {
+		c.Type("E")
+		c.Mode("B")
+	}
+	go func(w *Conn) {
+		w.Write([]byte("a\xc3"))
+		w.EndFile()
+		w.Write([]byte("b"))
+		w.EndFile()
+		w.Close()
+	}(w)
+	for _, want := range []string{"a\u001a", "b"} {
+		if got, _ := ioutil.ReadAll(r); string(got) != want {
+			t.Errorf("bad file: %q", got)
+		}
+	}
+	b.Close()
+
+	a, b = net.Pipe()
+	r = ActiveConn(b)
+	r.Type("E")
+	go func(a net.Conn) {
+		a.Write(raw)
+		a.Close()
+	}(a)
+	if got, _ := ioutil.ReadAll(r); string(got) != "Hello\nw\u00f6rld\u001a" {
+		t.Errorf("bad decoding: %q", got)
+	}
+}
+
+func TestRecordStructure(t *testing.T) {
+	a, b := net.Pipe()
+	w, r := ActiveConn(a), ActiveConn(b)
+	w.Structure("R")
+	go func(w *Conn) {
+		w.Write([]byte("ab\ncd\xff\nef"))
+		w.Close()
+	}(w)
+	raw, _ := ioutil.ReadAll(r)
+	if want := "ab\xff\x01cd\xff\xff\xff\x01ef\xff\x02"; string(raw) != want {
+		t.Errorf("bad encoding: %q", raw)
+	}
+
+	// An empty file is still ended.
+	a, b = net.Pipe()
+	w = ActiveConn(a)
+	w.Structure("R")
+	go w.Close()
+	if raw, _ := ioutil.ReadAll(b); string(raw) != "\xff\x02" {
+		t.Errorf("bad empty file: %q", raw)
+	}
+
+	a, b = net.Pipe()
+	r = ActiveConn(b)
+	r.Structure("R")
+	r.Type("E")
+	go func(a net.Conn) {
+		a.Write([]byte("\x81\xff\x01\xff\xff\xff\x03"))
+		a.Close()
+	}(a)
+	if got, _ := ioutil.ReadAll(r); string(got) != "a\n\u009f\n" {
+		t.Errorf("bad decoding: %q", got)
+	}
+
+	a, b = net.Pipe()
+	w, r = ActiveConn(a), ActiveConn(b)
+	for _, c := range []*Conn{w, r} {
+		c.Mode("B")
+		c.Structure("R")
+	}
+	go func(w *Conn) {
+		w.Write([]byte("one\ntwo\n"))
+		w.EndFile()
+	}(w)
+	if got, _ := ioutil.ReadAll(r); string(got) != "one\ntwo\n" {
+		t.Errorf("bad block mode records: %q", got)
+	}
+
+	c := dialTest(t, &FileHandler{FileSystem: newTestFS()})
+	for _, stru := range []struct {
+		msg  string
+		code int
+	}{{"F", 200}, {"P", 504}, {"X", 504}, {"R", 200}} {
+		if r := c.cmd("STRU " + stru.msg); r.Code != stru.code {
+			t.Errorf("STRU %s: %d %s", stru.msg, r.Code, r.Msg)
+		}
+	}
+	if r := c.cmd("STAT"); !strings.Contains(r.Msg, "STRU: Record") {
+		t.Error("bad status:", r.Msg)
+	}
+}
+
+func TestUserSettings(t *testing.T) {
+	home := newTestFS()
+	c := dialUser(t, &FileHandler{
+		Authorizer: testUserAuth{"foo": {FileSystem: home}},
+		FileSystem: newTestFS(),
+	}, "bar", "bar")
+	if r := c.cmd("PWD"); r.Code != 530 {
+		t.Fatal("login succeeded; should fail:", r.Code, r.Msg)
+	}
+	c.cmd("USER foo")
+	if r := c.cmd("PASS foo"); r.Code != 230 {
+		t.Fatal("login failed:", r.Code, r.Msg)
+	}
+
+	c.transfer("STOR foo.txt", "wow cool")
+	if _, err := home.Stat("foo.txt"); err != nil {
+		t.Fatal("file not in user's file system:", err)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	home := newTestFS()
+	c := dialUser(t, &FileHandler{
+		Authorizer: testUserAuth{"foo": {
+			FileSystem: home,
+			Quota:      Quota{Bytes: 10},
+		}},
+	}, "foo", "foo")
+
+	c.transfer("STOR a.txt", "wow cool")
+	if r := c.upload("STOR b.txt", "wow cool"); r.Code != 552 {
+		t.Fatal("upload should exceed quota:", r.Code, r.Msg)
+	}
+	if _, err := home.Stat("b.txt"); !os.IsNotExist(err) {
+		t.Error("refused upload left a file:", err)
+	}
+}
+
+func TestQuotaConcurrent(t *testing.T) {
+	h := &FileHandler{
+		Authorizer: testUserAuth{"foo": {
+			FileSystem: new(MemFileSystem),
+			Quota:      Quota{Bytes: 10},
+		}},
+	}
+	a := dialUser(t, h, "foo", "foo")
+	b := dialUser(t, h, "foo", "foo")
+
+	conn, r := a.open(0, "STOR a.txt")
+	defer conn.Close()
+	if r.Code != 150 {
+		t.Fatal(r.Code, r.Msg)
+	}
+	io.WriteString(conn, "12345678")
+	// Wait for the upload in progress to be charged.
+	for i := 0; b.cmd("AVBL").Msg != "2"; i++ {
+		if i == 100 {
+			t.Fatal("upload in progress not charged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if r := b.upload("STOR b.txt", "12345678"); r.Code != 552 {
+		t.Error(r.Code, r.Msg)
+	}
+	conn.Close()
+	if r := a.reply(); r.Code != 226 {
+		t.Error(r.Code, r.Msg)
+	}
+	if r := b.cmd("AVBL"); r.Msg != "2" {
+		t.Error(r.Code, r.Msg)
+	}
+}
+
+func TestQuotaLedger(t *testing.T) {
+	dir := t.TempDir()
+	home := path.Join(dir, "home")
+	os.Mkdir(home, 0755)
+	ioutil.WriteFile(path.Join(home, "a.txt"), []byte("hello"), 0644)
+	ledger := &FileLedger{Path: path.Join(dir, "ledger.json")}
+	handler := func() *FileHandler {
+		return &FileHandler{
+			Authorizer: testUserAuth{"foo": {
+				Root:  home,
+				Quota: Quota{Bytes: 10, Files: 3},
+			}},
+			Ledger: ledger,
+		}
+	}
+	c := dialUser(t, handler(), "foo", "foo")
+
+	c.cmd("TYPE I")
+	if r := c.cmd("AVBL"); r.Code != 213 || r.Msg != "5" {
+		t.Error(r.Code, r.Msg)
+	}
+	if r := c.upload("STOR b.txt", "too large"); r.Code != 552 {
+		t.Error(r.Code, r.Msg)
+	}
+	if _, err := os.Stat(path.Join(home, "b.txt")); !os.IsNotExist(err) {
+		t.Error("refused upload left a file:", err)
+	}
+	c.transfer("STOR c.txt", "abc")
+	if r := c.upload("APPE a.txt", "12345"); r.Code != 552 {
+		t.Error(r.Code, r.Msg)
+	}
+	if r := c.upload("STOR a.txt", "0123456789"); r.Code != 552 {
+		t.Error(r.Code, r.Msg)
+	}
+	if b, _ := ioutil.ReadFile(path.Join(home, "a.txt")); string(b) != "hello" {
+		t.Errorf("refused upload changed file: %q", b)
+	}
+	if r := c.cmd("AVBL"); r.Msg != "2" {
+		t.Error(r.Code, r.Msg)
+	}
+	r := c.cmd("SITE QUOTA")
+	for _, line := range []string{"Bytes used: 8", "Bytes limit: 10", "Files used: 2"} {
+		if !strings.Contains(r.Msg, line) {
+			t.Errorf("bad quota reply: %q", r.Msg)
+		}
+	}
+	if u, err := ledger.Load("foo"); err != nil || u != (Usage{8, 2}) {
+		t.Error("bad ledger:", u, err)
+	}
+
+	// Usage is loaded from the ledger rather than scanned.
+	ledger.Store("foo", Usage{Bytes: 9, Files: 2})
+	c = dialUser(t, handler(), "foo", "foo")
+	if r := c.cmd("AVBL"); r.Msg != "1" {
+		t.Error(r.Code, r.Msg)
+	}
+}
+
+// A Ledger that fails.
+type failLedger struct {
+	load Usage
+	err  error // Error for Load, if any.
+}
+
+func (l failLedger) Load(user string) (Usage, error) { return l.load, l.err }
+
+func (l failLedger) Store(user string, u Usage) error { return errors.New("disk full") }
+
+func TestQuotaLedgerFailure(t *testing.T) {
+	fs := new(MemFileSystem)
+	f, _ := fs.Create("/a.txt")
+	f.Write([]byte("hello"))
+	f.Close()
+	settings := &UserSettings{FileSystem: fs, Quota: Quota{Bytes: 10}}
+
+	// A deleted file is deleted, even if its usage cannot be recorded.
+	c := dialUser(t, &FileHandler{
+		Authorizer: testUserAuth{"foo": settings},
+		Ledger:     failLedger{load: Usage{5, 1}},
+	}, "foo", "foo")
+	if r := c.cmd("DELE a.txt"); r.Code != 250 {
+		t.Error(r.Code, r.Msg)
+	}
+	if r := c.cmd("NOOP"); r.Code != 200 {
+		t.Error(r.Code, r.Msg)
+	}
+
+	c = dialUser(t, &FileHandler{
+		Authorizer: testUserAuth{"foo": settings},
+		Ledger:     failLedger{err: errors.New("bad ledger")},
+	}, "foo", "bad")
+	c.cmd("USER foo")
+	if r := c.cmd("PASS foo"); r.Code != 451 {
+		t.Error(r.Code, r.Msg)
+	}
+	if r := c.cmd("USER foo"); r.Code != 331 {
+		t.Error(r.Code, r.Msg)
+	}
+}
+
+func TestAtomicUploads(t *testing.T) {
+	fs := newTestFS()
+	orphan, _ := fs.Create("/" + tempPrefix + "0" + tempSuffix)
+	orphan.Write([]byte("partial"))
+	orphan.Close()
+
+	h := &FileHandler{
+		FileSystem:    fs,
+		AtomicUploads: true,
+	}
+	if err := h.RemoveTempFiles(); err != nil {
+		t.Fatal(err)
+	}
+	c := dialTest(t, h)
+	c.transfer("STOR foo.txt", "wow cool")
+
+	for p := range fs {
+		if p != "/" && p != "/foo.txt" {
+			t.Error("unexpected file:", p)
+		}
+	}
+	if _, err := fs.Stat("/foo.txt"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRemoveTempFiles(t *testing.T) {
+	if tmp := tempName("/a/report.csv"); path.Dir(tmp) != "/a" || !isTempName(tmp) {
+		t.Error("bad temporary name:", tmp)
+	} else if ok, _ := path.Match("*.csv", path.Base(tmp)); ok {
+		t.Error("temporary name matches target pattern:", tmp)
+	}
+
+	mem := new(MemFileSystem)
+	dir := t.TempDir()
+	for _, fs := range []FileSystem{mem, &LocalFileSystem{Root: dir}} {
+		for _, name := range []string{tempName("/report.csv"), "/keep.csv"} {
+			f, _ := fs.Create(name)
+			f.Close()
+		}
+	}
+	h := new(FileHandler)
+	if err := h.RemoveTempFiles(&UserSettings{FileSystem: mem}, nil, &UserSettings{Root: dir}); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := ioutil.ReadDir(dir); len(list) != 1 || list[0].Name() != "keep.csv" {
+		t.Error("bad files left:", list)
+	}
+	if _, err := mem.Stat("/keep.csv"); err != nil {
+		t.Error(err)
+	}
+	if f, _ := mem.Open("/"); f != nil {
+		if list, _ := f.Readdir(-1); len(list) != 1 {
+			t.Error("bad files left:", len(list))
+		}
+		f.Close()
+	}
+}
+
+func TestAppend(t *testing.T) {
+	for _, fs := range []FileSystem{newTestFS(), new(MemFileSystem), &LocalFileSystem{Root: t.TempDir()}} {
+		c := dialTest(t, &FileHandler{FileSystem: fs})
+		c.transfer("APPE log.txt", "one\n")
+		c.transfer("APPE log.txt", "two\n")
+		if _, b := c.transfer("RETR log.txt", ""); b != "one\ntwo\n" {
+			t.Errorf("%T: bad data: %q", fs, b)
+		}
+	}
+
+	// Without OpenFileFS, appending is not possible.
+	c := dialTest(t, &FileHandler{FileSystem: struct{ FileSystem }{newTestFS()}})
+	if r := c.upload("APPE log.txt", "one\n"); r.Code != 502 {
+		t.Error(r.Code, r.Msg)
+	}
+	if r := c.cmd("HELP"); !strings.Contains(r.Msg, " APPE ") {
+		t.Error("APPE not in help:", r.Msg)
+	}
+}
+
+func TestUnique(t *testing.T) {
+	dir := t.TempDir()
+	c := dialTest(t, &FileHandler{
+		FileSystem:  &LocalFileSystem{Root: dir},
+		UniqueNames: "up-*.txt",
+	})
+
+	r, _ := c.transfer("STOU", "unique")
+	name := strings.TrimPrefix(r.Msg, "FILE: ")
+	if !strings.HasPrefix(name, "up-") || !strings.HasSuffix(name, ".txt") {
+		t.Fatal("bad unique name:", r.Msg)
+	}
+	if b, _ := ioutil.ReadFile(path.Join(dir, name)); string(b) != "unique" {
+		t.Errorf("bad data: %q", b)
+	}
+}
+
+// A LocalFileSystem that cannot rename files.
+type noRenameFS struct {
+	*LocalFileSystem
+}
+
+func (noRenameFS) Rename(old, new string) error {
+	return os.ErrPermission
+}
+
+func TestUniqueAtomicFailure(t *testing.T) {
+	dir := t.TempDir()
+	c := dialTest(t, &FileHandler{
+		FileSystem:    noRenameFS{&LocalFileSystem{Root: dir}},
+		AtomicUploads: true,
+	})
+
+	if r := c.upload("STOU", "unique"); r.Code != 550 {
+		t.Error(r.Code, r.Msg)
+	}
+	if list, _ := ioutil.ReadDir(dir); len(list) != 0 {
+		t.Error("failed upload left a file:", list[0].Name())
+	}
+}
+
+func TestResume(t *testing.T) {
+	for _, fs := range []FileSystem{newTestFS(), &LocalFileSystem{Root: t.TempDir()}} {
+		c := dialTest(t, &FileHandler{FileSystem: fs})
+		c.transfer("STOR f", "hello world")
+		c.transferAt(6, "STOR f", "there")
+		if _, b := c.transfer("RETR f", ""); b != "hello there" {
+			t.Errorf("%T: bad data: %q", fs, b)
+		}
+		c.transferAt(6, "STOR f", "xy")
+		c.transferAt(8, "APPE f", "!")
+		if _, b := c.transfer("RETR f", ""); b != "hello xy!" {
+			t.Errorf("%T: bad data: %q", fs, b)
+		}
+
+		for _, cmd := range []string{"STOR f", "APPE f"} {
+			c.cmd("EPSV")
+			c.cmd("REST 100")
+			if r := c.cmd(cmd); r.Code != 554 {
+				t.Errorf("%T: %s: %d %s", fs, cmd, r.Code, r.Msg)
+			}
+		}
+	}
+}
+
+func TestMLSD(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(path.Join(dir, "sub"), 0755)
+	ioutil.WriteFile(path.Join(dir, "a.txt"), []byte("hello"), 0644)
+	c := dialTest(t, &FileHandler{
+		FileSystem: &LocalFileSystem{Root: dir},
+	})
+
+	if r := c.cmd("OPTS MLST type;size;bogus;"); r.Msg != "MLST OPTS type;size;" {
+		t.Error("bad OPTS reply:", r.Msg)
+	}
+	_, data := c.transfer("MLSD", "")
+	if !strings.Contains(data, "type=file;size=5; a.txt\r\n") ||
+		!strings.Contains(data, "type=dir; sub\r\n") {
+		t.Errorf("bad listing: %q", data)
+	}
+
+	r := c.cmd("MLST a.txt")
+	if lines := r.Lines(); r.Code != 250 || len(lines) != 3 {
+		t.Fatal("bad reply:", r.Code, r.Msg)
+	} else if lines[1] != " type=file;size=5; /a.txt" {
+		t.Errorf("bad facts: %q", lines[1])
+	}
+}
+
+func TestMFMT(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(path.Join(dir, "a.txt"), []byte("hello"), 0644)
+	c := dialTest(t, &FileHandler{
+		FileSystem: &LocalFileSystem{Root: dir},
+	})
+
+	if r := c.cmd("MFMT 20200102030405 a.txt"); r.Code != 213 {
+		t.Fatal(r.Code, r.Msg)
+	} else if r.Msg != "Modify=20200102030405; a.txt" {
+		t.Error("bad reply:", r.Msg)
+	}
+	if r := c.cmd("MDTM a.txt"); r.Msg != "20200102030405" {
+		t.Error("bad time:", r.Msg)
+	}
+	if r := c.cmd("MFF Create=20200102030405; a.txt"); r.Code != 504 {
+		t.Error("bad reply:", r.Code, r.Msg)
+	}
+}
+
+func TestSite(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(path.Join(dir, "a.txt"), []byte("hello"), 0644)
+	c := dialTest(t, &FileHandler{
+		FileSystem: &LocalFileSystem{Root: dir},
+		Site: map[string]SiteFunc{
+			"PING": func(r *SiteRequest) error {
+				return r.Reply(200, "PONG %s", r.Args)
+			},
+		},
+	})
+
+	if r := c.cmd("SITE CHMOD 600 a.txt"); r.Code != 200 {
+		t.Error(r.Code, r.Msg)
+	} else if fi, _ := os.Stat(path.Join(dir, "a.txt")); fi.Mode() != 0600 {
+		t.Error("bad mode:", fi.Mode())
+	}
+	if r := c.cmd("SITE SYMLINK /a.txt b.txt"); r.Code != 200 {
+		t.Error(r.Code, r.Msg)
+	} else if l, _ := os.Readlink(path.Join(dir, "b.txt")); l != "a.txt" {
+		t.Error("bad link:", l)
+	}
+	if _, list := c.transfer("LIST", ""); !strings.Contains(list, " b.txt -> a.txt") {
+		t.Error("bad list:", list)
+	}
+	if r := c.cmd("STAT b.txt"); !strings.Contains(r.Msg, " b.txt -> a.txt") {
+		t.Error("bad status:", r.Msg)
+	}
+	uid := strconv.Itoa(os.Getuid())
+	if r := c.cmd("SITE CHOWN " + uid + " a.txt"); r.Code != 200 {
+		t.Error(r.Code, r.Msg)
+	}
+	if r := c.cmd("SITE CHOWN user a.txt"); r.Code != 501 {
+		t.Error(r.Code, r.Msg)
+	}
+	if r := c.cmd("SITE SYMLINK ../../etc/passwd x"); r.Code != 550 {
+		t.Error(r.Code, r.Msg)
+	} else if _, err := os.Lstat(path.Join(dir, "x")); !os.IsNotExist(err) {
+		t.Error("escaping link created:", err)
+	}
+	if r := c.cmd("SITE UTIME 20200102030405 a.txt"); r.Code != 200 {
+		t.Error(r.Code, r.Msg)
+	} else if fi, _ := os.Stat(path.Join(dir, "a.txt")); !fi.ModTime().Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Error("bad time:", fi.ModTime())
+	}
+	if r := c.cmd("SITE UTIME a.txt 20210102030405 20210102030405 20210102030405 UTC"); r.Code != 200 {
+		t.Error(r.Code, r.Msg)
+	} else if fi, _ := os.Stat(path.Join(dir, "a.txt")); fi.ModTime().Year() != 2021 {
+		t.Error("bad time:", fi.ModTime())
+	}
+	if r := c.cmd("SITE HELP"); r.Code != 214 || !strings.Contains(r.Msg, "CHMOD CHOWN HELP PING QUOTA SYMLINK UMASK UTIME") {
+		t.Error(r.Code, r.Msg)
+	}
+	if r := c.cmd("SITE UMASK 077"); r.Code != 200 {
+		t.Error(r.Code, r.Msg)
+	}
+	c.transfer("STOR c.txt", "data")
+	if fi, _ := os.Stat(path.Join(dir, "c.txt")); fi.Mode() != 0600 {
+		t.Error("bad mode:", fi.Mode())
+	}
+	if r := c.cmd("SITE ping x"); r.Msg != "PONG x" {
+		t.Error(r.Code, r.Msg)
+	}
+
+	c = dialTest(t, &FileHandler{FileSystem: newTestFS()})
+	if r := c.cmd("SITE CHMOD 600 a.txt"); r.Code != 502 {
+		t.Error(r.Code, r.Msg)
+	}
+}
+
+func TestLinks(t *testing.T) {
+	dir := t.TempDir()
+	root := path.Join(dir, "root")
+	os.Mkdir(root, 0755)
+	ioutil.WriteFile(path.Join(dir, "secret.txt"), []byte("secret"), 0644)
+	ioutil.WriteFile(path.Join(root, "a.txt"), []byte("hello"), 0644)
+	os.Symlink("a.txt", path.Join(root, "in"))
+	os.Symlink(path.Join(dir, "secret.txt"), path.Join(root, "out"))
+	os.Symlink(dir, path.Join(root, "up"))
+	fs := &LocalFileSystem{Root: root}
+	c := dialTest(t, &FileHandler{FileSystem: fs})
+
+	if _, data := c.transfer("RETR in", ""); data != "hello" {
+		t.Error("bad data:", data)
+	}
+	if r := c.cmd("SIZE out"); r.Code != 550 {
+		t.Error(r.Code, r.Msg)
+	}
+	if r := c.cmd("SIZE up/secret.txt"); r.Code != 550 {
+		t.Error(r.Code, r.Msg)
+	}
+
+	fs.Links = LinksNone
+	if r := c.cmd("SIZE in"); r.Code != 550 {
+		t.Error(r.Code, r.Msg)
+	}
+	if r := c.cmd("STAT in"); r.Code != 550 {
+		t.Error(r.Code, r.Msg)
+	}
+	if r := c.cmd("DELE in"); r.Code != 250 {
+		t.Error(r.Code, r.Msg)
+	}
+
+	// A changed Root is used, rather than the one opened first.
+	fs.Root = dir
+	if _, err := fs.Stat("secret.txt"); err != nil {
+		t.Error(err)
+	}
+	fs.Close()
+}
+
+func TestMemFileSystem(t *testing.T) {
+	fs := new(MemFileSystem)
+	c := dialTest(t, &FileHandler{FileSystem: fs})
+
+	c.cmd("TYPE I")
+	c.transfer("STOR a.txt", "hello world")
+	if r := c.cmd("MKD d"); r.Code != 257 {
+		t.Fatal(r.Code, r.Msg)
+	}
+	c.cmd("RNFR a.txt")
+	if r := c.cmd("RNTO d/b.txt"); r.Code != 250 {
+		t.Error(r.Code, r.Msg)
+	}
+	c.transferAt(6, "STOR d/b.txt", "there")
+	if _, data := c.transfer("RETR d/b.txt", ""); data != "hello there" {
+		t.Error("bad data:", data)
+	}
+	if r := c.cmd("SITE SYMLINK /d/b.txt l"); r.Code != 200 {
+		t.Error(r.Code, r.Msg)
+	}
+	if _, data := c.transfer("RETR l", ""); data != "hello there" {
+		t.Error("bad data:", data)
+	}
+	if _, list := c.transfer("NLST", ""); list != "d\nl\n" {
+		t.Errorf("bad list: %q", list)
+	}
+	if _, list := c.transfer("LIST", ""); !strings.Contains(list, " l -> /d/b.txt") {
+		t.Error("bad list:", list)
+	}
+	if r := c.cmd("MFMT 20200102030405 l"); r.Code != 213 {
+		t.Error(r.Code, r.Msg)
+	}
+	if r := c.cmd("MDTM d/b.txt"); r.Msg != "20200102030405" {
+		t.Error("bad time:", r.Msg)
+	}
+	if r := c.cmd("RMD d"); r.Code != 550 {
+		t.Error(r.Code, r.Msg)
+	}
+	if r := c.cmd("DELE l"); r.Code != 250 {
+		t.Error(r.Code, r.Msg)
+	}
+	if fi, err := fs.Stat("/d/b.txt"); err != nil || fi.Size() != 11 {
+		t.Error(fi, err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			f, err := fs.Create(name)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			f.Write([]byte(name))
+			f.Close()
+			fs.Rename(name, "/d/"+name)
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+	dir, _ := fs.Open("d")
+	if list, _ := dir.Readdir(0); len(list) != 9 {
+		t.Error("bad list:", len(list))
+	}
+}
+
+func TestFromFS(t *testing.T) {
+	c := dialTest(t, &FileHandler{FileSystem: FromFS(fstest.MapFS{
+		"a.txt":   {Data: []byte("hello")},
+		"d/b.txt": {Data: []byte("world")},
+	})})
+
+	c.cmd("TYPE I")
+	if _, data := c.transfer("RETR d/b.txt", ""); data != "world" {
+		t.Error("bad data:", data)
+	}
+	if _, data := c.transferAt(2, "RETR a.txt", ""); data != "llo" {
+		t.Error("bad data:", data)
+	}
+	if _, list := c.transfer("NLST", ""); list != "a.txt\nd\n" {
+		t.Errorf("bad list: %q", list)
+	}
+	if r := c.cmd("MKD e"); r.Code != 550 {
+		t.Error(r.Code, r.Msg)
+	}
+	if r := c.cmd("DELE a.txt"); r.Code != 550 {
+		t.Error(r.Code, r.Msg)
+	}
+}
+
+func TestToFS(t *testing.T) {
+	mem := new(MemFileSystem)
+	mem.Mkdir("d")
+	f, _ := mem.Create("d/a.txt")
+	f.Write([]byte("hello"))
+	f.Close()
+	mem.Symlink("d/a.txt", "l")
+
+	dir := t.TempDir()
+	os.Mkdir(path.Join(dir, "d"), 0755)
+	ioutil.WriteFile(path.Join(dir, "d/a.txt"), []byte("hello"), 0644)
+
+	for _, fsys := range []FileSystem{mem, &LocalFileSystem{Root: dir}} {
+		if err := fstest.TestFS(ToFS(fsys), "d/a.txt"); err != nil {
+			t.Errorf("%T: %v", fsys, err)
+		}
+	}
+	if b, err := fs.ReadFile(ToFS(mem), "l"); string(b) != "hello" {
+		t.Error(string(b), err)
+	}
+	if _, err := fs.Stat(ToFS(mem), "b.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Error(err)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	var zbuf bytes.Buffer
+	zw := zip.NewWriter(&zbuf)
+	for _, m := range []uint16{zip.Store, zip.Deflate} {
+		w, _ := zw.CreateHeader(&zip.FileHeader{
+			Name:   fmt.Sprintf("d/e/%d.txt", m),
+			Method: m,
+		})
+		w.Write([]byte("hello world"))
+	}
+	zw.Close()
+
+	var tbuf bytes.Buffer
+	tw := tar.NewWriter(&tbuf)
+	tw.WriteHeader(&tar.Header{Name: "d/a.txt", Mode: 0644, Size: 11})
+	tw.Write([]byte("hello world"))
+	tw.WriteHeader(&tar.Header{Name: "l", Typeflag: tar.TypeSymlink, Linkname: "d/a.txt"})
+	tw.WriteHeader(&tar.Header{Name: "cur", Typeflag: tar.TypeSymlink, Linkname: "d"})
+	tw.Close()
+	var gbuf bytes.Buffer
+	gw := gzip.NewWriter(&gbuf)
+	gw.Write(tbuf.Bytes())
+	gw.Close()
+
+	name := path.Join(t.TempDir(), "a.zip")
+	ioutil.WriteFile(name, zbuf.Bytes(), 0644)
+	a, err := OpenArchive(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	c := dialTest(t, &FileHandler{FileSystem: a})
+	c.cmd("TYPE I")
+	if _, list := c.transfer("NLST d/e", ""); list != "0.txt\n8.txt\n" {
+		t.Errorf("bad list: %q", list)
+	}
+	for _, f := range []string{"d/e/0.txt", "d/e/8.txt"} {
+		if _, data := c.transferAt(6, "RETR "+f, ""); data != "world" {
+			t.Error("bad data:", f, data)
+		}
+	}
+	if r := c.cmd("DELE d/e/0.txt"); r.Code != 550 {
+		t.Error(r.Code, r.Msg)
+	}
+	f, _ := a.Open("d/e/0.txt")
+	f.Seek(6, io.SeekStart)
+	f.Read(make([]byte, 5))
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Error("cannot seek stored file:", err)
+	}
+	f.Close()
+
+	for _, b := range [][]byte{tbuf.Bytes(), gbuf.Bytes()} {
+		a, err := NewArchive(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := dialTest(t, &FileHandler{FileSystem: a})
+		c.cmd("TYPE I")
+		if _, data := c.transferAt(6, "RETR l", ""); data != "world" {
+			t.Error("bad data:", data)
+		}
+		if _, list := c.transfer("LIST", ""); !strings.Contains(list, " l -> d/a.txt") {
+			t.Error("bad list:", list)
+		}
+		if _, data := c.transfer("RETR cur/a.txt", ""); data != "hello world" {
+			t.Error("bad data:", data)
+		}
+		if r := c.cmd("SIZE cur/a.txt"); r.Msg != "11" {
+			t.Error(r.Code, r.Msg)
+		}
+	}
+}
+
+func TestHash(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(path.Join(dir, "a.txt"), []byte("hello"), 0644)
+	c := dialTest(t, &FileHandler{
+		FileSystem: &LocalFileSystem{Root: dir},
+	})
+
+	sha := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if r := c.cmd("HASH a.txt"); r.Msg != "SHA-256 0-4 "+sha+" a.txt" {
+		t.Error(r.Code, r.Msg)
+	}
+	if r := c.cmd("OPTS HASH MD5"); r.Code != 200 {
+		t.Error(r.Code, r.Msg)
+	}
+	c.cmd("RANG 1 3")
+	if r := c.cmd("HASH a.txt"); r.Msg != "MD5 1-3 "+md5hex("ell")+" a.txt" {
+		t.Error(r.Code, r.Msg)
+	}
+	c.cmd("RANG 4 4")
+	if r := c.cmd("HASH a.txt"); r.Msg != "MD5 4-4 "+md5hex("o")+" a.txt" {
+		t.Error(r.Code, r.Msg)
+	}
+	if r := c.cmd("RANG 1 0"); r.Code != 350 {
+		t.Error(r.Code, r.Msg)
+	}
+	if r := c.cmd("XMD5 a.txt"); r.Msg != md5hex("hello") {
+		t.Error(r.Code, r.Msg)
+	}
+	if r := c.cmd("XCRC a.txt 0 4"); r.Msg != "3610a686" {
+		t.Error(r.Code, r.Msg)
+	}
+	if r := c.cmd("XMD5 a.txt 1 3"); r.Msg != md5hex("ell") {
+		t.Error(r.Code, r.Msg)
+	}
+	if r := c.cmd("XMD5 a.txt 4 4"); r.Msg != md5hex("o") {
+		t.Error(r.Code, r.Msg)
+	}
+}
+
+func md5hex(s string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(s)))
+}
+
+func TestAbort(t *testing.T) {
+	dir := t.TempDir()
+	big := bytes.Repeat([]byte("0123456789abcdef"), 1<<20)
+	ioutil.WriteFile(path.Join(dir, "big"), big, 0644)
+	c := dialTest(t, &FileHandler{
+		FileSystem: &LocalFileSystem{Root: dir},
+	})
+
+	if r := c.cmd("STAT"); r.Code != 211 || !strings.Contains(r.Msg, "Logged in as foo") {
+		t.Error("bad status:", r.Code, r.Msg)
+	}
+	r := c.cmd("EPSV")
+	port, _ := ParseEPSV(r.Msg)
+	conn, err := net.Dial("tcp", net.JoinHostPort("localhost", fmt.Sprint(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if r := c.cmd("RETR big"); r.Code != 150 {
+		t.Fatal(r.Code, r.Msg)
+	}
+
+	// The data connection is not read, so the transfer stalls.
+	if r := c.cmd("STAT"); r.Code != 211 || !strings.Contains(r.Msg, "RETR /big: ") {
+		t.Error("bad status:", r.Code, r.Msg)
+	}
+	if r := c.cmd("\xff\xf4\xffABOR"); r.Code != 426 {
+		t.Error("bad reply:", r.Code, r.Msg)
+	}
+	if r := c.reply(); r.Code != 226 {
+		t.Error("bad reply:", r.Code, r.Msg)
+	}
+	if r := c.cmd("ABOR"); r.Code != 225 {
+		t.Error("bad reply:", r.Code, r.Msg)
+	}
+}
+
+func TestUploadPolicy(t *testing.T) {
+	p := &UploadPolicy{
+		Allow:     []string{"*.txt", "*.csv"},
+		Deny:      []string{"secret*"},
+		Forbidden: "<>|",
+	}
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"/a/report.txt", true},
+		{"/a/REPORT.CSV", true},
+		{"/a/report.exe", false},
+		{"/a/secret.txt", false},
+		{"/a/re|port.txt", false},
+	}
+	for _, tt := range tests {
+		if err := p.CheckName(tt.name); (err == nil) != tt.ok {
+			t.Errorf("CheckName(%q) = %v; want ok = %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestUploadPolicyLimits(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(path.Join(dir, "b.txt"), []byte("hello"), 0644)
+	c := dialTest(t, &FileHandler{
+		FileSystem: &LocalFileSystem{Root: dir},
+		Uploads:    &UploadPolicy{MaxSize: 8, Forbidden: "|"},
+	})
+
+	c.cmd("TYPE I")
+	if r := c.upload("STOR a.txt", "too large"); r.Code != 552 {
+		t.Error(r.Code, r.Msg)
+	}
+	if _, err := os.Stat(path.Join(dir, "a.txt")); !os.IsNotExist(err) {
+		t.Error("refused upload left a file:", err)
+	}
+	if r := c.upload("STOR b.txt", "too large"); r.Code != 552 {
+		t.Error(r.Code, r.Msg)
+	}
+	if b, _ := ioutil.ReadFile(path.Join(dir, "b.txt")); string(b) != "hello" {
+		t.Errorf("refused upload changed file: %q", b)
+	}
+	if r := c.upload("STOR a|b.txt", "data"); r.Code != 553 {
+		t.Error(r.Code, r.Msg)
+	}
+	if list, _ := ioutil.ReadDir(dir); len(list) != 1 {
+		t.Error("unexpected files:", len(list))
+	}
+}
+
+func TestUploadPolicyRename(t *testing.T) {
+	c := dialTest(t, &FileHandler{
+		FileSystem: new(MemFileSystem),
+		Uploads:    &UploadPolicy{Allow: []string{"*.txt"}},
+	})
+
+	c.cmd("MKD reports")
+	c.cmd("RNFR reports")
+	if r := c.cmd("RNTO archive"); r.Code != 250 {
+		t.Error(r.Code, r.Msg)
+	}
+	c.transfer("STOR a.txt", "hello")
+	c.cmd("RNFR a.txt")
+	if r := c.cmd("RNTO a.exe"); r.Code != 553 {
+		t.Error(r.Code, r.Msg)
+	}
+}
+
+func TestACL(t *testing.T) {
+	acl := ACL{
+		{Users: []string{"foo"}, Path: "/home/foo", Allow: AccessAll},
+		{Groups: []string{"staff"}, Path: "/pub", Allow: AccessAll},
+		{Path: "/pub/*.key", Deny: AccessAll},
+		{Path: "/pub", Allow: AccessRead | AccessList},
+	}
+	tests := []struct {
+		user   string
+		groups []string
+		op     Access
+		path   string
+		ok     bool
+	}{
+		{"foo", nil, AccessWrite, "/home/foo/a/b.txt", true},
+		{"bar", nil, AccessWrite, "/home/foo/a/b.txt", false},
+		{"bar", nil, AccessRead, "/pub/a.txt", true},
+		{"bar", nil, AccessWrite, "/pub/a.txt", false},
+		{"bar", nil, AccessRead, "/pub/a.key", false},
+		{"bar", []string{"staff"}, AccessWrite, "/pub/a.key", true},
+		{"bar", nil, AccessList, "/", false},
+	}
+	for _, tt := range tests {
+		if ok := acl.Allow(tt.user, tt.groups, tt.op, tt.path); ok != tt.ok {
+			t.Errorf("Allow(%q, %q, %d, %q) = %v; want %v",
+				tt.user, tt.groups, tt.op, tt.path, ok, tt.ok)
+		}
+	}
+}
+
+func TestACLSession(t *testing.T) {
+	fs := new(MemFileSystem)
+	fs.Mkdir("/pub")
+	for _, name := range []string{"a.txt", "a.key", "hidden.txt"} {
+		f, _ := fs.Create("/pub/" + name)
+		f.Write([]byte("hello"))
+		f.Close()
+	}
+	c := dialUser(t, &FileHandler{
+		Authorizer: testUserAuth{"foo": {Groups: []string{"staff"}}},
+		FileSystem: fs,
+		ACL: ACL{
+			{Path: "/pub/hidden.txt", Deny: AccessList},
+			{Groups: []string{"staff"}, Path: "/pub/*.key", Deny: AccessRead | AccessWrite},
+			{Path: "/pub/*.log", Deny: AccessWrite},
+			{Path: "/", Allow: AccessAll},
+		},
+		Site: map[string]SiteFunc{
+			"READABLE": func(r *SiteRequest) error {
+				if !r.Allow(AccessRead, r.Args) {
+					return r.Reply(550, "No.")
+				}
+				return r.Reply(200, "Yes.")
+			},
+		},
+	}, "foo", "foo")
+
+	if r := c.upload("RETR pub/a.key", ""); r.Code != 550 {
+		t.Error(r.Code, r.Msg)
+	}
+	if r := c.upload("STOR pub/b.key", "key"); r.Code != 550 {
+		t.Error(r.Code, r.Msg)
+	}
+	if _, err := fs.Stat("/pub/b.key"); !os.IsNotExist(err) {
+		t.Error("denied upload was stored:", err)
+	}
+	if _, data := c.transfer("RETR pub/a.txt", ""); data != "hello" {
+		t.Error("bad data:", data)
+	}
+
+	c.cmd("TYPE I")
+	if _, list := c.transfer("NLST pub", ""); list != "a.key\na.txt\n" {
+		t.Errorf("bad name list: %q", list)
+	}
+	if _, list := c.transfer("LIST pub", ""); strings.Contains(list, "hidden") || !strings.Contains(list, " a.txt") {
+		t.Errorf("bad list: %q", list)
+	}
+	if r := c.cmd("STAT pub"); strings.Contains(r.Msg, "hidden") || !strings.Contains(r.Msg, " a.txt") {
+		t.Errorf("bad status: %q", r.Msg)
+	}
+	if r := c.cmd("SIZE pub/hidden.txt"); r.Code != 550 {
+		t.Error(r.Code, r.Msg)
+	}
+
+	// Links may not expose what the user cannot read.
+	for _, cmd := range []string{"SITE SYMLINK /pub/a.key /l", "SITE SYMLINK a.key /pub/l"} {
+		if r := c.cmd(cmd); r.Code != 550 {
+			t.Error(cmd, r.Code, r.Msg)
+		}
+	}
+	if r := c.cmd("HASH l"); r.Code != 550 {
+		t.Error(r.Code, r.Msg)
+	}
+	if r := c.cmd("SITE SYMLINK a.txt /pub/l"); r.Code != 200 {
+		t.Error(r.Code, r.Msg)
+	}
+
+	// Appending may not create a file the user may not write.
+	f, _ := fs.Create("/pub/a.log")
+	f.Close()
+	c.transfer("APPE pub/a.log", "one\n")
+	if r := c.upload("APPE pub/b.log", "one\n"); r.Code != 550 {
+		t.Error(r.Code, r.Msg)
+	}
+	if _, err := fs.Stat("/pub/b.log"); !os.IsNotExist(err) {
+		t.Error("denied append created a file:", err)
+	}
+
+	// Custom SITE commands can check the ACL.
+	if r := c.cmd("SITE READABLE pub/a.key"); r.Code != 550 {
+		t.Error(r.Code, r.Msg)
+	}
+	if r := c.cmd("SITE READABLE a.txt"); r.Code != 200 {
+		t.Error(r.Code, r.Msg)
+	}
+}
+
 func newTLS() *tls.Config {
 	now := time.Now()
 	tmpl := &x509.Certificate{
@@ -163,7 +1476,9 @@ type testFile struct {
 	mode os.FileMode
 	time time.Time
 	r    *bytes.Reader
-	w    *bytes.Buffer
+	w    []byte // Data written, if wr is set.
+	wr   bool   // Whether the file is open for writing.
+	off  int64  // Offset of the next write.
 	list []os.FileInfo
 }
 
@@ -175,22 +1490,46 @@ func (f *testFile) Read(b []byte) (n int, err error) {
 }
 
 func (f *testFile) Write(b []byte) (n int, err error) {
-	if f.w == nil {
-		f.w = new(bytes.Buffer)
+	f.wr = true
+	if end := f.off + int64(len(b)); end > int64(len(f.w)) {
+		f.w = append(f.w, make([]byte, end-int64(len(f.w)))...)
 	}
-	return f.w.Write(b)
+	copy(f.w[f.off:], b)
+	f.off += int64(len(b))
+	return len(b), nil
+}
+
+func (f *testFile) Truncate(n int64) error {
+	if !f.wr {
+		return errors.New("nope")
+	}
+	if n < int64(len(f.w)) {
+		f.w = f.w[:n]
+	} else {
+		f.w = append(f.w, make([]byte, n-int64(len(f.w)))...)
+	}
+	return nil
 }
 
 func (f *testFile) Close() error {
-	if f.w != nil {
-		f.r = bytes.NewReader(f.w.Bytes())
+	if f.wr {
+		f.r = bytes.NewReader(f.w)
 		f.size = f.r.Size()
-		f.w = nil
+		f.w, f.wr, f.off = nil, false, 0
 		f.fs[f.path] = f
 	}
 	return nil
 }
 
+// Return the contents of the file.
+func (f *testFile) data() []byte {
+	b := make([]byte, f.size)
+	if f.r != nil {
+		f.r.ReadAt(b, 0)
+	}
+	return b
+}
+
 func (f *testFile) Readdir(n int) ([]os.FileInfo, error) {
 	if n <= 0 {
 		return f.readdir(), nil
@@ -235,6 +1574,16 @@ func (f *testFile) readdir() (fi fileInfos) {
 }
 
 func (f *testFile) Seek(off int64, whence int) (int64, error) {
+	if f.wr {
+		switch whence {
+		case io.SeekCurrent:
+			off += f.off
+		case io.SeekEnd:
+			off += int64(len(f.w))
+		}
+		f.off = off
+		return off, nil
+	}
 	if f.r == nil {
 		return 0, errors.New("nope")
 	}
@@ -268,6 +1617,31 @@ func (f testFS) Create(p string) (File, error) {
 	return tf, nil
 }
 
+func (f testFS) OpenFile(p string, flag int, perm os.FileMode) (File, error) {
+	old := f[f.path(p)]
+	if old == nil && flag&os.O_CREATE == 0 {
+		return nil, os.ErrNotExist
+	} else if old != nil && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+		return nil, os.ErrExist
+	} else if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return f.Open(p)
+	}
+	tf := &testFile{
+		fs:   f,
+		path: f.path(p),
+		mode: perm,
+		time: time.Now(),
+		wr:   true,
+	}
+	if old != nil && flag&os.O_TRUNC == 0 {
+		tf.w = old.data()
+	}
+	if flag&os.O_APPEND != 0 {
+		tf.off = int64(len(tf.w))
+	}
+	return tf, nil
+}
+
 func (f testFS) Open(p string) (File, error) {
 	tf := f[f.path(p)]
 	if tf == nil {
@@ -321,3 +1695,129 @@ type testAuth struct{}
 func (testAuth) Authorize(user, pass string) (bool, error) {
 	return user == "foo" && pass == "bar", nil
 }
+
+// A testConn speaks the protocol directly to a test server.
+type testConn struct {
+	*textproto.Conn
+	t *testing.T
+}
+
+// Serve h on a new server, and log in to it.
+func dialTest(t *testing.T, h Handler) *testConn {
+	return dialUser(t, h, "foo", "bar")
+}
+
+// Like dialTest, but logs in as user with pass.
+func dialUser(t *testing.T, h Handler, user, pass string) *testConn {
+	s := &Server{
+		Addr:    "localhost:0",
+		Handler: h,
+	}
+	li, err := s.ListenAndServe(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := textproto.Dial("tcp", li.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		li.Close()
+	})
+	c := &testConn{conn, t}
+	c.reply()
+	c.cmd("USER " + user)
+	c.cmd("PASS " + pass)
+	return c
+}
+
+// Read a reply.
+func (c *testConn) reply() *Reply {
+	r := new(Reply)
+	if err := r.Decode(&c.Reader); err != nil {
+		c.t.Fatal(err)
+	}
+	return r
+}
+
+// Send a command and read the reply.
+func (c *testConn) cmd(line string) *Reply {
+	if err := c.PrintfLine("%s", line); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.reply()
+}
+
+// Open a passive data connection, send a command, and write data to the data
+// connection, or read from it if data is "". This returns the preliminary
+// reply and the data read.
+func (c *testConn) transfer(cmd, data string) (*Reply, string) {
+	return c.transferAt(0, cmd, data)
+}
+
+// Like transfer, but restarts at off if it is not 0.
+func (c *testConn) transferAt(off int64, cmd, data string) (*Reply, string) {
+	conn, prelim := c.open(off, cmd)
+	defer conn.Close()
+	if prelim.Code != 150 {
+		c.t.Fatal(cmd, prelim.Code, prelim.Msg)
+	} else if data == "" {
+		b, _ := ioutil.ReadAll(conn)
+		data = string(b)
+	} else {
+		io.WriteString(conn, data)
+		conn.Close()
+		data = ""
+	}
+	if r := c.reply(); r.Code != 226 {
+		c.t.Fatal(cmd, r.Code, r.Msg)
+	}
+	return prelim, data
+}
+
+// Upload data with cmd, which may fail. This returns the final reply.
+func (c *testConn) upload(cmd, data string) *Reply {
+	conn, prelim := c.open(0, cmd)
+	defer conn.Close()
+	if prelim.Code != 150 {
+		return prelim
+	}
+	io.WriteString(conn, data)
+	conn.Close()
+	return c.reply()
+}
+
+// Open a passive data connection and send a command, restarting at off if it
+// is not 0. This returns the connection and the reply to the command.
+func (c *testConn) open(off int64, cmd string) (net.Conn, *Reply) {
+	r := c.cmd("EPSV")
+	port, err := ParseEPSV(r.Msg)
+	if err != nil {
+		c.t.Fatal(r.Msg)
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort("localhost", fmt.Sprint(port)))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if off != 0 {
+		if r := c.cmd(fmt.Sprint("REST ", off)); r.Code != 350 {
+			conn.Close()
+			c.t.Fatal(r.Code, r.Msg)
+		}
+	}
+	return conn, c.cmd(cmd)
+}
+
+type testUserAuth map[string]*UserSettings
+
+func (a testUserAuth) Authorize(user, pass string) (bool, error) {
+	return a[user] != nil && user == pass, nil
+}
+
+func (a testUserAuth) AuthorizeUser(user, pass string) (*UserSettings, error) {
+	if ok, err := a.Authorize(user, pass); !ok || err != nil {
+		return nil, err
+	}
+	return a[user], nil
+}
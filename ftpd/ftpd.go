@@ -9,14 +9,29 @@ import (
 
 func main() {
 	addr := flag.String("addr", "", "addr to bind control channel")
+	atomic := flag.Bool("atomic", false, "rename uploads into place once complete")
+	noLinks := flag.Bool("nolinks", false, "do not follow symbolic links")
 
 	flag.Parse()
 
+	fs := &ftp.LocalFileSystem{}
+	if *noLinks {
+		fs.Links = ftp.LinksNone
+	}
+	handler := &ftp.FileHandler{
+		FileSystem:    fs,
+		AtomicUploads: *atomic,
+	}
+	if *atomic {
+		if err := handler.RemoveTempFiles(); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+
 	server := ftp.Server{
-		Addr: *addr,
-		Handler: &ftp.FileHandler{
-			FileSystem: &ftp.LocalFileSystem{},
-		},
+		Addr:    *addr,
+		Handler: handler,
 	}
 	_, err := server.ListenAndServe(false)
 	fmt.Println(err)
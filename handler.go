@@ -1,9 +1,13 @@
 package ftp
 
 import (
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"io"
 	"os"
+	pathpkg "path"
 	"sort"
 	"strconv"
 	"strings"
@@ -12,6 +16,10 @@ import (
 const mdtmFormat = "20060102150405"
 
 var errNoDataConn = errors.New("no data channel connection")
+var errNotSupported = errors.New("not supported by file system")
+var errNotDir = errors.New("not a directory")
+var errRestart = errors.New("invalid restart position")
+var errNotFile = errors.New("not a regular file")
 
 // A Handler for a session.
 type Handler interface {
@@ -29,10 +37,47 @@ type Authorizer interface {
 	Authorize(user, pass string) (bool, error)
 }
 
+// A UserAuthorizer is an Authorizer that also provides per-user settings. If
+// the Authorizer of a FileHandler implements this, AuthorizeUser is used
+// instead of Authorize.
+type UserAuthorizer interface {
+	Authorizer
+
+	// AuthorizeUser authorizes the user, returning settings for the rest of
+	// the session. Returning nil settings denies the login. Returning an error
+	// closes the session.
+	AuthorizeUser(user, pass string) (*UserSettings, error)
+}
+
+// UserSettings are per-user settings returned by a UserAuthorizer.
+type UserSettings struct {
+	FileSystem FileSystem // FileSystem to serve. If nil, Root is used.
+	Root       string     // Root of a LocalFileSystem to serve, if not "".
+	Dir        string     // Dir is the initial working directory.
+	Groups     []string   // Groups the user belongs to.
+	Quota      Quota      // Quota limits the user's storage.
+}
+
 // A FileHandler serves from a FileSystem.
 type FileHandler struct {
 	Authorizer // Authorizer for login. If nil, accept all.
 	FileSystem // FileSystem to serve.
+
+	ACL     AccessControl       // ACL restricts operations. If nil, allow all.
+	Site    map[string]SiteFunc // Site adds or overrides SITE commands.
+	Ledger  Ledger              // Ledger records quota usage. If nil, scan at login.
+	Uploads *UploadPolicy       // Uploads restricts uploads. If nil, allow all.
+
+	// UniqueNames is the pattern for names chosen by STOU. The last "*" is
+	// replaced by a random string. If "", "ftp*" is used.
+	UniqueNames string
+
+	// AtomicUploads makes STOR write to a hidden temporary file that is
+	// renamed onto the target only once the transfer completes. Restarted
+	// uploads are written in place.
+	AtomicUploads bool
+
+	quotas quotas
 }
 
 // Handle implements Handler.
@@ -40,19 +85,37 @@ func (h *FileHandler) Handle(s *Session) error {
 	fs := fileSession{
 		FileHandler: h,
 		Session:     s,
+		FileSystem:  h.FileSystem,
+		rangeEnd:    -1,
 	}
-	return fs.Handle()
+	err := fs.Handle()
+	if fs.local != nil {
+		fs.local.Close()
+	}
+	return err
 }
 
 // A fileSession wraps session state for a FileHandler.
 type fileSession struct {
 	*FileHandler
 	*Session
+	FileSystem // FileSystem for the session. This shadows the handler's.
 
-	authed   bool   // Whether we're done with auth.
-	renaming string // The file we're renaming, if any.
-	epsvOnly bool   // Whether we saw "EPSV ALL".
-	restart  int64  // Restart offset.
+	settings *UserSettings    // Settings for the logged in user, if any.
+	local    *LocalFileSystem // FileSystem made for the user's Root, if any.
+	authed   bool             // Whether we're done with auth.
+	renaming string           // The file we're renaming, if any.
+	epsvOnly bool             // Whether we saw "EPSV ALL".
+	restart  int64            // Restart offset.
+	facts    []string         // Facts for MLST and MLSD, if set by OPTS.
+	umask    os.FileMode      // Umask for new files, if umasked.
+	umasked  bool             // Whether SITE UMASK was used.
+	hash     string           // Algorithm for HASH, if set by OPTS.
+	xfer     *transfer        // Transfer in progress, if any.
+	aborted  bool             // Whether a transfer was aborted by ABOR.
+
+	rangeStart int64 // Start of range set by RANG.
+	rangeEnd   int64 // End of range set by RANG, or -1 if unset.
 }
 
 func (s *fileSession) Handle() error {
@@ -73,6 +136,9 @@ func (s *fileSession) Handle() error {
 		if c.Cmd != "REST" {
 			s.restart = 0
 		}
+		if c.Cmd != "RANG" {
+			s.rangeStart, s.rangeEnd = 0, -1
+		}
 	}
 }
 
@@ -101,7 +167,22 @@ func (s *fileSession) handlePreAuth(c *Command) error {
 		if s.User == "" {
 			return s.Reply(503, "Log in with USER first.")
 		}
-		if s.Authorizer != nil {
+		if ua, ok := s.Authorizer.(UserAuthorizer); ok {
+			us, err := ua.AuthorizeUser(s.User, c.Msg)
+			if err != nil {
+				s.User = ""
+				return err
+			} else if us == nil {
+				s.User = ""
+				return s.Reply(430, "Invalid user name or password.")
+			}
+			if err := s.login(us); err != nil {
+				s.Server.logf("ftp: loading usage of %s: %v", s.User, err)
+				s.User, s.settings = "", nil
+				s.FileSystem = s.FileHandler.FileSystem
+				return s.Reply(451, "Could not load quota usage.")
+			}
+		} else if s.Authorizer != nil {
 			if ok, err := s.Authorize(s.User, c.Msg); err != nil {
 				s.User = ""
 				return err
@@ -142,6 +223,11 @@ func (s *fileSession) handlePostAuth(c *Command) error {
 			return s.Reply(504, err.Error())
 		}
 		return s.Reply(200, "Mode switched successfully.")
+	case "STRU":
+		if err := s.SetStructure(c.Msg); err != nil {
+			return s.Reply(504, err.Error())
+		}
+		return s.Reply(200, "Structure switched successfully.")
 	case "PWD":
 		path := s.Path("")
 		return s.Reply(257, "%s is the current directory.", quote(path))
@@ -150,6 +236,9 @@ func (s *fileSession) handlePostAuth(c *Command) error {
 			return s.Reply(550, "Failed to change directory.")
 		}
 		path := s.Path(c.Msg)
+		if err := s.access(AccessList, path); err != nil {
+			return s.Reply(550, "Insufficient permissions.")
+		}
 		if stat, err := s.Stat(path); isPermission(err) {
 			return s.Reply(550, "Insufficient permissions.")
 		} else if isNotExist(err) {
@@ -161,6 +250,9 @@ func (s *fileSession) handlePostAuth(c *Command) error {
 		return s.Reply(250, "Directory successfully changed.")
 	case "CDUP":
 		path := s.Path("..")
+		if err := s.access(AccessList, path); err != nil {
+			return s.Reply(550, "Insufficient permissions.")
+		}
 		if stat, err := s.Stat(path); isPermission(err) {
 			return s.Reply(550, "Insufficient permissions.")
 		} else if isNotExist(err) {
@@ -172,12 +264,19 @@ func (s *fileSession) handlePostAuth(c *Command) error {
 		return s.Reply(250, "Directory successfully changed.")
 	case "MKD":
 		path := s.Path(c.Msg)
+		if err := s.access(AccessMkdir, path); err != nil {
+			return s.Reply(550, "Insufficient permissions.")
+		}
 		if err := s.Mkdir(path); err != nil {
 			return s.Reply(550, "Failed to create directory.")
 		}
+		s.applyUmask(path, 0777)
 		return s.Reply(257, "%s created.", quote(path))
 	case "SIZE":
 		path := s.Path(c.Msg)
+		if err := s.access(AccessList, path); err != nil {
+			return s.Reply(550, "Insufficient permissions.")
+		}
 		stat, err := s.Stat(path)
 		if isPermission(err) {
 			return s.Reply(550, "Insufficient permissions.")
@@ -188,10 +287,21 @@ func (s *fileSession) handlePostAuth(c *Command) error {
 		} else if stat.IsDir() {
 			return s.Reply(550, "Path specifies a directory.")
 		}
-		size := strconv.FormatInt(stat.Size(), 10)
-		return s.Reply(213, size)
+		size := stat.Size()
+		if s.Type == "A" || s.Type == "E" {
+			size, err = s.textSize(path, size)
+			if err == errTextSize {
+				return s.Reply(550, "SIZE not allowed for large files in this TYPE.")
+			} else if err != nil {
+				return s.Reply(550, "Could not get size.")
+			}
+		}
+		return s.Reply(213, strconv.FormatInt(size, 10))
 	case "MDTM":
 		path := s.Path(c.Msg)
+		if err := s.access(AccessList, path); err != nil {
+			return s.Reply(550, "Insufficient permissions.")
+		}
 		stat, err := s.Stat(path)
 		if isPermission(err) {
 			return s.Reply(550, "Insufficient permissions.")
@@ -200,13 +310,19 @@ func (s *fileSession) handlePostAuth(c *Command) error {
 		} else if err != nil || stat.IsDir() {
 			return s.Reply(550, "Could not get size.")
 		}
-		mdtm := stat.ModTime().Format(mdtmFormat)
+		mdtm := stat.ModTime().UTC().Format(mdtmFormat)
 		return s.Reply(213, mdtm)
+	case "MFMT", "MFCT", "MFF":
+		return s.modifyFacts(c)
 	case "DELE", "RMD":
 		if c.Msg == "" {
 			return s.Reply(501, "A file name is required.")
 		}
 		path := s.Path(c.Msg)
+		if err := s.access(AccessDelete, path); err != nil {
+			return s.Reply(550, "Insufficient permissions.")
+		}
+		old := s.statUsage(path)
 		if err := s.Remove(path); isPermission(err) {
 			return s.Reply(550, "Insufficient permissions.")
 		} else if isNotExist(err) {
@@ -214,12 +330,19 @@ func (s *fileSession) handlePostAuth(c *Command) error {
 		} else if err != nil {
 			return s.Reply(550, "Could not delete file.")
 		}
+		if err := s.updateUsage(path, old); err != nil {
+			s.Server.logf("ftp: recording usage of %s: %v", s.User, err)
+		}
 		return s.Reply(250, "Successfully deleted file.")
 	case "RNFR":
 		if c.Msg == "" {
 			return s.Reply(501, "A file name is required.")
 		}
-		s.renaming = s.Path(c.Msg)
+		path := s.Path(c.Msg)
+		if err := s.access(AccessRename, path); err != nil {
+			return s.Reply(550, "Insufficient permissions.")
+		}
+		s.renaming = path
 		return s.Reply(350, "Call RNTO to specify destination.")
 	case "RNTO":
 		if c.Msg == "" {
@@ -228,6 +351,15 @@ func (s *fileSession) handlePostAuth(c *Command) error {
 			return s.Reply(503, "Call RNFR first.")
 		}
 		old, new := s.renaming, s.Path(c.Msg)
+		if err := s.access(AccessRename, new); err != nil {
+			return s.Reply(550, "Insufficient permissions.")
+		}
+		// The upload policy names files, so directories are exempt.
+		if fi, err := s.Stat(old); err == nil && fi.Mode().IsRegular() {
+			if err := s.checkUpload(new); err != nil {
+				return s.replyPolicy(err)
+			}
+		}
 		if err := s.Rename(old, new); isPermission(err) {
 			return s.Reply(550, "Insufficient permissions.")
 		} else if isNotExist(err) {
@@ -298,11 +430,32 @@ func (s *fileSession) handlePostAuth(c *Command) error {
 		}
 		s.restart = n
 		return s.Reply(350, "Restart position accepted (%d).", n)
+	case "RANG":
+		args := strings.Split(c.Msg, " ")
+		if len(args) != 2 {
+			return s.Reply(501, "Invalid syntax.")
+		}
+		a, aerr := strconv.ParseInt(args[0], 10, 64)
+		z, zerr := strconv.ParseInt(args[1], 10, 64)
+		if aerr != nil || zerr != nil || a < 0 || z < 0 {
+			return s.Reply(501, "Invalid syntax.")
+		}
+		if a == 1 && z == 0 {
+			return s.Reply(350, "Range reset.")
+		} else if a > z {
+			return s.Reply(501, "Invalid range.")
+		}
+		s.rangeStart, s.rangeEnd = a, z
+		return s.Reply(350, "Restarting at %d. Ending at %d.", a, z)
+	case "HASH":
+		return s.hashFile(c)
+	case "XCRC", "XMD5", "XSHA1", "XSHA256":
+		return s.hashLegacy(c)
 	case "STAT":
 		if c.Msg == "" {
-			return s.Reply(211, "Looks good to me.")
+			return s.Reply(211, s.status())
 		}
-		list, err := s.stat(c.Msg)
+		dir, list, err := s.stat(s.Path(c.Msg))
 		if isPermission(err) {
 			return s.Reply(550, "Insufficient permissions.")
 		} else if isNotExist(err) {
@@ -311,12 +464,31 @@ func (s *fileSession) handlePostAuth(c *Command) error {
 			return s.Reply(550, "Error retrieving status.")
 		}
 		msg := []string{"Status:"}
-		msg = append(msg, listLines(list)...)
+		msg = append(msg, listLines(dir, list, s.readlink)...)
 		msg = append(msg, "End.")
 		return s.Reply(213, strings.Join(msg, "\n"))
-	case "LIST", "NLST":
+	case "MLST":
+		path := s.Path(c.Msg)
+		if err := s.access(AccessList, path); err != nil {
+			return s.Reply(550, "Insufficient permissions.")
+		}
+		stat, err := s.Stat(path)
+		if isPermission(err) {
+			return s.Reply(550, "Insufficient permissions.")
+		} else if isNotExist(err) {
+			return s.Reply(550, "No such file or directory.")
+		} else if err != nil {
+			return s.Reply(550, "Error retrieving status.")
+		}
+		line := mlstLine(s.mlstFacts(), path, stat, s.allowed())
+		return s.Reply(250, "Listing %s\n%s %s\nEnd.", path, line, path)
+	case "LIST", "NLST", "MLSD":
 		if err := s.list(c); err == errNoDataConn {
 			return s.Reply(425, "Use PORT or PASV first.")
+		} else if err == errAborted {
+			return s.Reply(426, "Connection closed; transfer aborted.")
+		} else if err == errNotDir {
+			return s.Reply(501, "Not a directory.")
 		} else if isPermission(err) {
 			return s.Reply(550, "Insufficient permissions.")
 		} else if isNotExist(err) {
@@ -328,6 +500,8 @@ func (s *fileSession) handlePostAuth(c *Command) error {
 	case "RETR":
 		if err := s.retrieve(c); err == errNoDataConn {
 			return s.Reply(425, "Use PORT or PASV first.")
+		} else if err == errAborted {
+			return s.Reply(426, "Connection closed; transfer aborted.")
 		} else if isPermission(err) {
 			return s.Reply(550, "Insufficient permissions.")
 		} else if isNotExist(err) {
@@ -336,15 +510,36 @@ func (s *fileSession) handlePostAuth(c *Command) error {
 			return s.Reply(550, "Error retrieving file.")
 		}
 		return s.Reply(226, "Transfer complete.")
-	case "STOR":
-		if err := s.store(c); err == errNoDataConn {
+	case "STOR", "APPE", "STOU":
+		path, err := s.store(c)
+		if err == errNoDataConn {
 			return s.Reply(425, "Use PORT or PASV first.")
+		} else if err == errAborted {
+			return s.Reply(426, "Connection closed; transfer aborted.")
+		} else if err == errNotSupported {
+			return s.Reply(502, "Not supported by file system.")
+		} else if err == errRestart {
+			return s.Reply(554, "Invalid restart position.")
+		} else if err == errQuotaExceeded {
+			return s.Reply(552, "Quota exceeded.")
+		} else if _, ok := err.(*PolicyError); ok {
+			return s.replyPolicy(err)
 		} else if isPermission(err) {
 			return s.Reply(550, "Insufficient permissions.")
 		} else if err != nil {
 			return s.Reply(550, "Error storing file.")
 		}
+		if c.Cmd == "STOU" {
+			return s.Reply(226, "Transfer complete. FILE: %s", pathpkg.Base(path))
+		}
 		return s.Reply(226, "Transfer complete.")
+	case "AVBL":
+		if n := s.available(); n >= 0 {
+			return s.Reply(213, strconv.FormatInt(n, 10))
+		}
+		return s.Reply(550, "Available space unknown.")
+	case "SITE":
+		return s.site(c)
 	case "PBSZ":
 		if s.Server.TLS == nil {
 			return s.Reply(502, "Not implemented.")
@@ -367,28 +562,64 @@ func (s *fileSession) handlePostAuth(c *Command) error {
 		}
 		return s.Reply(200, "Protection level changed.")
 	case "OPTS":
-		if msg := strings.ToUpper(c.Msg); msg == "UTF8 ON" {
-			return s.Reply(200, "Always in UTF8 mode.")
-		}
-		return s.Reply(501, "Option not understood.")
+		return s.opts(c)
 	case "HELP":
 		return s.Reply(214,
 			`The following commands are recognized.
-CDUP CWD  DELE EPRT EPSV FEAT HELP LIST MDTM MKD  MODE NLST NOOP OPTS
-PASS PASV PBSZ PORT PROT PWD  QUIT REST RETR RMD  RNFR RNTO SIZE STAT
-STOR SYST TYPE USER
+ABOR APPE AVBL CDUP CWD  DELE EPRT EPSV FEAT HASH HELP LIST MDTM MFCT
+MFF  MFMT MKD  MLSD MLST MODE NLST NOOP OPTS PASS PASV PBSZ PORT PROT
+PWD  QUIT RANG REST RETR RMD  RNFR RNTO SITE SIZE STAT STOR STOU STRU
+SYST TYPE USER XCRC XMD5 XSHA1 XSHA256
 Help OK.`)
 	case "NOOP":
 		return s.Reply(200, "OK.")
+	case "ABOR":
+		if s.aborted {
+			s.aborted = false
+			return s.Reply(226, "Abort successful.")
+		}
+		return s.Reply(225, "No transfer to abort.")
 	default:
 		return s.handlePreAuth(c)
 	}
 }
 
+// Apply settings for a user that has logged in.
+func (s *fileSession) login(us *UserSettings) error {
+	s.settings = us
+	if us.FileSystem != nil {
+		s.FileSystem = us.FileSystem
+	} else if us.Root != "" {
+		fs := &LocalFileSystem{Root: us.Root}
+		if local, ok := s.FileHandler.FileSystem.(*LocalFileSystem); ok {
+			fs.Links = local.Links
+		}
+		if s.local != nil {
+			s.local.Close()
+		}
+		s.FileSystem, s.local = fs, fs
+	}
+	if us.Dir != "" {
+		s.Dir = s.Path(us.Dir)
+	}
+	return s.loadUsage()
+}
+
 // Return supported features.
 func (s *fileSession) features() []string {
 	f := []string{
-		"EPRT", "EPSV", "MDTM", "PASV", "REST STREAM", "SIZE", "UTF8",
+		"AVBL", "EPRT", "EPSV", "MDTM", "MODE Z", "PASV", "REST STREAM", "SIZE",
+		"UTF8",
+	}
+	f = append(f, featHash(s.hashAlgo()), featMLST(s.mlstFacts()))
+	if facts := s.mffFacts(); len(facts) > 0 {
+		f = append(f, "MFF "+strings.Join(facts, ";")+";")
+	}
+	if _, ok := s.FileSystem.(ChtimesFS); ok {
+		f = append(f, "MFMT")
+	}
+	if _, ok := s.FileSystem.(CreateTimeFS); ok {
+		f = append(f, "MFCT")
 	}
 	if s.Server.TLS != nil {
 		f = append(f, "PBSZ", "PROT")
@@ -397,12 +628,122 @@ func (s *fileSession) features() []string {
 	return f
 }
 
+// Return the reply to STAT without an argument.
+func (s *fileSession) status() string {
+	msg := []string{"FTP server status:"}
+	if s.Addr != nil {
+		msg = append(msg, "Connected to "+s.Addr.String())
+	}
+	msg = append(msg, "Logged in as "+s.User)
+	typ, mode := "ASCII", "Stream"
+	switch s.Type {
+	case "I":
+		typ = "Image"
+	case "E":
+		typ = "EBCDIC"
+	}
+	switch s.Mode {
+	case "B":
+		mode = "Block"
+	case "Z":
+		mode = "Deflate"
+	}
+	stru := "File"
+	if s.Stru == "R" {
+		stru = "Record"
+	}
+	msg = append(msg, "TYPE: "+typ+", MODE: "+mode+", STRU: "+stru)
+	switch d := s.Data; {
+	case d == nil:
+		msg = append(msg, "No data connection")
+	case d.Active():
+		msg = append(msg, "Data connection open")
+	default:
+		msg = append(msg, "Waiting for data connection on "+d.Addr().String())
+	}
+	if s.TLS != nil {
+		msg = append(msg, "Protection level: Private")
+	} else {
+		msg = append(msg, "Protection level: Clear")
+	}
+	if s.xfer != nil {
+		msg = append(msg, s.transferStatus())
+	}
+	return strings.Join(append(msg, "End of status."), "\n")
+}
+
+// Handler for OPTS.
+func (s *fileSession) opts(c *Command) error {
+	args := strings.SplitN(c.Msg, " ", 2)
+	switch strings.ToUpper(args[0]) {
+	case "UTF8":
+		if msg := strings.ToUpper(c.Msg); msg == "UTF8 ON" {
+			return s.Reply(200, "Always in UTF8 mode.")
+		}
+	case "HASH":
+		if len(args) < 2 {
+			return s.Reply(200, s.hashAlgo())
+		}
+		algo := strings.ToUpper(args[1])
+		if newHash(algo) == nil {
+			return s.Reply(501, "Unknown algorithm.")
+		}
+		s.hash = algo
+		return s.Reply(200, algo)
+	case "MODE":
+		// The only option for MODE Z is LEVEL.
+		opt := strings.Fields(strings.ToUpper(c.Msg))
+		if len(opt) != 4 || opt[1] != "Z" || opt[2] != "LEVEL" {
+			break
+		}
+		n, err := strconv.Atoi(opt[3])
+		if err != nil || n < zlib.NoCompression || s.SetLevel(n) != nil {
+			return s.Reply(501, "Invalid compression level.")
+		}
+		return s.Reply(200, "MODE Z LEVEL set to %d.", n)
+	case "MLST":
+		var list string
+		if len(args) > 1 {
+			list = args[1]
+		}
+		s.facts = selectFacts(list)
+		msg := "MLST OPTS"
+		if len(s.facts) > 0 {
+			msg += " " + strings.Join(s.facts, ";") + ";"
+		}
+		return s.Reply(200, msg)
+	}
+	return s.Reply(501, "Option not understood.")
+}
+
+// Return the facts to give for MLST and MLSD.
+func (s *fileSession) mlstFacts() []string {
+	if s.facts == nil {
+		return mlstFacts
+	}
+	return s.facts
+}
+
+// Return a function to restrict MLST perm facts, if there is an ACL.
+func (s *fileSession) allowed() func(Access, string) bool {
+	if s.ACL == nil {
+		return nil
+	}
+	return func(op Access, p string) bool {
+		return s.access(op, p) == nil
+	}
+}
+
 // Handler for RETR.
 func (s *fileSession) retrieve(c *Command) error {
 	if s.Data == nil {
 		return errNoDataConn
 	}
 	path := s.Path(c.Msg)
+	if err := s.access(AccessRead, path); err != nil {
+		s.CloseData()
+		return err
+	}
 	file, err := s.Open(path)
 	if err != nil {
 		s.CloseData()
@@ -420,76 +761,339 @@ func (s *fileSession) retrieve(c *Command) error {
 			return err
 		}
 	}
-	if _, err := io.Copy(s.Data, file); err != nil {
+	var dst io.Writer = s.Data
+	if s.Mode == "B" {
+		dst = &markWriter{s.Data, s.restart}
+	}
+	if _, err := s.copy(c, path, dst, file); err != nil {
 		file.Close()
 		s.CloseData()
 		return err
 	}
 	file.Close()
-	return s.CloseData()
+	return s.endData()
 }
 
-// Handler for STOR.
-func (s *fileSession) store(c *Command) error {
+// Handler for STOR, APPE and STOU. This returns the path that was stored.
+func (s *fileSession) store(c *Command) (string, error) {
 	if s.Data == nil {
-		return errNoDataConn
+		return "", errNoDataConn
 	}
 	path := s.Path(c.Msg)
-	file, err := s.Create(path)
+	if c.Cmd == "STOU" {
+		path = s.Path(s.uniqueName(c.Msg))
+	}
+	op := AccessWrite
+	if c.Cmd == "APPE" {
+		op = AccessAppend
+		if _, err := s.Stat(path); isNotExist(err) {
+			op |= AccessWrite // Appending creates the file.
+		}
+	}
+	check := func(path string) error {
+		if err := s.access(op, path); err != nil {
+			return err
+		}
+		return s.checkUpload(path)
+	}
+	if err := check(path); err != nil {
+		s.CloseData()
+		return "", err
+	}
+	if err := s.checkRestart(c.Cmd, path); err != nil {
+		s.CloseData()
+		return "", err
+	}
+	old := s.statUsage(path)
+	if old == nil && !s.canCreate() {
+		s.CloseData()
+		return "", errQuotaExceeded
+	}
+	_, err := s.Stat(path)
+	existed := err == nil
+	if s.umasked && isNotExist(err) {
+		defer func() { s.applyUmask(path, 0666) }()
+	}
+	// Stage a replacement that may be refused, so the old file is kept.
+	limited := existed && (s.available() >= 0 || s.Uploads != nil && s.Uploads.MaxSize > 0)
+	var file File
+	dst, kept, msg := path, s.restart, "Awaiting file data."
+	switch c.Cmd {
+	case "APPE":
+		flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		if fi, err := s.Stat(path); err == nil {
+			kept = fi.Size()
+		}
+		file, err = s.openFile(dst, flag, 0666)
+	case "STOU":
+		flag := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+		file, err = s.openFile(path, flag, 0666)
+		for i := 0; isExist(err) && i < 10; i++ {
+			path = s.Path(s.uniqueName(c.Msg))
+			if err = check(path); err == nil {
+				file, err = s.openFile(path, flag, 0666)
+			}
+		}
+		dst, msg = path, "FILE: "+pathpkg.Base(path)
+		if err == nil && s.AtomicUploads {
+			// The name is reserved, so write elsewhere and rename onto it.
+			file.Close()
+			dst = tempName(path)
+			if file, err = s.Create(dst); err != nil {
+				s.Remove(path)
+			}
+		}
+	default:
+		if s.restart > 0 {
+			// Resume without truncating what was already stored.
+			file, err = s.openFile(dst, os.O_WRONLY|os.O_CREATE, 0666)
+			break
+		}
+		if s.AtomicUploads || limited {
+			dst = tempName(path)
+		}
+		file, err = s.Create(dst)
+	}
 	if err != nil {
 		s.CloseData()
-		return err
+		return "", err
 	}
-	if err := s.Reply(150, "Awaiting file data."); err != nil {
+	// Whether path is an empty file reserving the name chosen by STOU.
+	reserved := c.Cmd == "STOU" && dst != path
+	if err := s.Reply(150, msg); err != nil {
 		file.Close()
 		s.CloseData()
-		return err
+		s.abortUpload(dst, path, reserved)
+		return "", err
 	}
-	if s.restart > 0 {
+	if s.restart > 0 && c.Cmd == "STOR" {
 		if _, err := file.Seek(s.restart, io.SeekStart); err != nil {
 			file.Close()
 			s.CloseData()
-			return err
+			return "", err
 		}
 	}
-	if _, err := io.Copy(file, s.Data); err != nil {
+	var w io.Writer = file
+	var qw *quotaWriter
+	if s.available() >= 0 {
+		qw = &quotaWriter{w: file, s: s}
+		if old != nil && old.Size() > kept {
+			qw.free = old.Size() - kept
+		}
+		w = qw
+	}
+	if s.Uploads != nil && s.Uploads.MaxSize > 0 {
+		n := s.Uploads.MaxSize - kept
+		if n < 0 {
+			n = 0
+		}
+		w = &limitWriter{w, n, s.Uploads.sizeError()}
+	}
+	if s.Mode == "B" {
+		data := s.Data
+		data.OnMark(func(m string, n int64) {
+			s.send(110, "MARK "+m+" = "+strconv.FormatInt(kept+n, 10))
+		})
+		defer data.OnMark(nil)
+	}
+	n, err := s.copy(c, path, w, s.Data)
+	if err != nil {
+		refused := isRefused(err)
+		if refused && dst == path && existed {
+			// Drop what the refused upload added to the file.
+			s.truncate(file, dst, kept)
+		}
 		file.Close()
 		s.CloseData()
-		return err
+		s.abortUpload(dst, path, reserved || refused && !existed)
+		s.settleUsage(path, old, qw.total())
+		return "", err
+	}
+	if s.restart > 0 && c.Cmd == "STOR" {
+		// Drop anything stored after the end of the resumed upload.
+		err := s.truncate(file, dst, s.restart+n)
+		if err != nil && err != errNotSupported {
+			file.Close()
+			s.CloseData()
+			s.settleUsage(path, old, qw.total())
+			return "", err
+		}
 	}
 	err = file.Close()
-	s.CloseData()
-	return err
+	if s.Mode != "B" {
+		s.CloseData()
+	}
+	if err != nil {
+		s.abortUpload(dst, path, reserved)
+	} else if dst != path {
+		if err = s.Rename(dst, path); err != nil {
+			s.abortUpload(dst, path, reserved)
+		}
+	}
+	if uerr := s.settleUsage(path, old, qw.total()); uerr != nil {
+		s.Server.logf("ftp: recording usage of %s: %v", s.User, uerr)
+	}
+	return path, err
 }
 
-// Handler for STAT.
-func (s *fileSession) stat(p string) ([]os.FileInfo, error) {
+// A truncater is a File that can be truncated, like os.File.
+type truncater interface {
+	Truncate(size int64) error
+}
+
+// Truncate the open file at p to size.
+func (s *fileSession) truncate(file File, p string, size int64) error {
+	if t, ok := file.(truncater); ok {
+		return t.Truncate(size)
+	} else if fs, ok := s.FileSystem.(TruncateFS); ok {
+		return fs.Truncate(p, size)
+	}
+	return errNotSupported
+}
+
+// Check the restart offset given by REST for an upload to p. STOR may resume
+// within or at the end of the file, and APPE only at the end.
+func (s *fileSession) checkRestart(cmd, p string) error {
+	if s.restart == 0 {
+		return nil
+	}
+	var size int64
+	if stat, err := s.Stat(p); err == nil {
+		size = stat.Size()
+	} else if !isNotExist(err) {
+		return err
+	}
+	switch {
+	case cmd == "STOR" && s.restart <= size:
+		return nil
+	case cmd == "APPE" && s.restart == size:
+		return nil
+	}
+	return errRestart
+}
+
+// Return a name for STOU. If the client suggested a name, it is used as the
+// pattern. Otherwise, UniqueNames is used.
+func (s *fileSession) uniqueName(hint string) string {
+	pattern := s.UniqueNames
+	if hint != "" {
+		pattern = hint
+		if !strings.Contains(hint, "*") {
+			pattern += ".*"
+		}
+	} else if pattern == "" {
+		pattern = "ftp*"
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	i := strings.LastIndex(pattern, "*")
+	if i < 0 {
+		return pattern + hex.EncodeToString(b)
+	}
+	return pattern[:i] + hex.EncodeToString(b) + pattern[i+1:]
+}
+
+// Open a file with flags, if the file system supports it.
+func (s *fileSession) openFile(p string, flag int, perm os.FileMode) (File, error) {
+	if fs, ok := s.FileSystem.(OpenFileFS); ok {
+		return fs.OpenFile(p, flag, perm)
+	}
+	return nil, errNotSupported
+}
+
+// Clean up after an upload to path that failed. The temporary file dst is
+// removed, and path too if remove is set.
+func (s *fileSession) abortUpload(dst, path string, remove bool) {
+	if dst != path {
+		s.Remove(dst)
+	}
+	if remove {
+		s.Remove(path)
+	}
+}
+
+// Check a path against the upload policy.
+func (s *fileSession) checkUpload(p string) error {
+	if s.Uploads == nil {
+		return nil
+	}
+	return s.Uploads.CheckName(p)
+}
+
+// Reply to a command that violated the upload policy.
+func (s *fileSession) replyPolicy(err error) error {
+	pe := err.(*PolicyError)
+	return s.Reply(pe.code, "Denied by upload policy: %s.", pe.Rule)
+}
+
+// Handler for STAT. This returns the directory containing the files listed.
+func (s *fileSession) stat(p string) (string, []os.FileInfo, error) {
+	if err := s.access(AccessList, p); err != nil {
+		return "", nil, err
+	}
 	stat, err := s.Stat(p)
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 	if !stat.IsDir() {
-		return []os.FileInfo{stat}, nil
+		if stat, err = s.lstat(p); err != nil {
+			return "", nil, err
+		}
+		return pathpkg.Dir(p), []os.FileInfo{stat}, nil
 	}
 	file, err := s.Open(p)
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 	list, err := file.Readdir(0)
 	if err != nil {
 		file.Close()
-		return nil, err
+		return "", nil, err
 	}
 	file.Close()
-	return list, nil
+	return p, s.listable(p, list), nil
 }
 
-// Handler for LIST and NLST.
+// Stat a file without following a link, if the FileSystem allows.
+func (s *fileSession) lstat(p string) (os.FileInfo, error) {
+	if fs, ok := s.FileSystem.(LstatFS); ok {
+		return fs.Lstat(p)
+	}
+	return s.Stat(p)
+}
+
+// Return the target of a link, or "" if it cannot be read.
+func (s *fileSession) readlink(p string) string {
+	fs, ok := s.FileSystem.(ReadlinkFS)
+	if !ok {
+		return ""
+	}
+	target, err := fs.Readlink(p)
+	if err != nil {
+		return ""
+	}
+	return target
+}
+
+// Handler for LIST, NLST and MLSD.
 func (s *fileSession) list(c *Command) error {
 	if s.Data == nil {
 		return errNoDataConn
 	}
 	path := s.Path(stripListFlags(c.Msg))
+	if err := s.access(AccessList, path); err != nil {
+		s.CloseData()
+		return err
+	}
+	if c.Cmd == "MLSD" {
+		if stat, err := s.Stat(path); err != nil {
+			s.CloseData()
+			return err
+		} else if !stat.IsDir() {
+			s.CloseData()
+			return errNotDir
+		}
+	}
 	file, err := s.Open(path)
 	if err != nil {
 		s.CloseData()
@@ -501,16 +1105,33 @@ func (s *fileSession) list(c *Command) error {
 		return err
 	}
 	list := Lister{
-		File: file,
-		Cmd:  c.Cmd,
+		File:     &listFile{file, s, path},
+		Cmd:      c.Cmd,
+		Dir:      path,
+		Facts:    s.mlstFacts(),
+		access:   s.allowed(),
+		readlink: s.readlink,
 	}
-	if _, err := list.WriteTo(s.Data); err != nil {
+	if _, err := s.copy(c, path, s.Data, &list); err != nil {
 		file.Close()
 		s.CloseData()
 		return err
 	}
 	file.Close()
-	return s.CloseData()
+	return s.endData()
+}
+
+// Finish sending on the data connection. In block mode, the connection is
+// kept open for another transfer.
+func (s *fileSession) endData() error {
+	if s.Mode != "B" {
+		return s.CloseData()
+	}
+	if err := s.Data.EndFile(); err != nil {
+		s.CloseData()
+		return err
+	}
+	return nil
 }
 
 // Some clients assume LIST accepts flags like ls. This removes those.
@@ -544,7 +1165,7 @@ func isNotExist(err error) bool {
 
 // Check if an error implies a file already exists.
 func isExist(err error) bool {
-	return os.IsPermission(err)
+	return os.IsExist(err)
 }
 
 // Quote returns a quoted string with double-escaped quotes.
@@ -0,0 +1,170 @@
+package ftp
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// HashFS is a FileSystem that can provide precomputed hashes of files.
+type HashFS interface {
+	FileSystem
+
+	// Hash returns the hash of the whole file at path. The algorithm is
+	// named as for the HASH command, such as "SHA-256". If this returns an
+	// error, the hash is computed by reading the file.
+	Hash(path, algo string) ([]byte, error)
+}
+
+// Hash algorithms supported by HASH, in the order given by FEAT.
+var hashAlgos = []string{"SHA-1", "SHA-256", "SHA-512", "MD5", "CRC32"}
+
+// The default algorithm for HASH.
+const defaultHash = "SHA-256"
+
+// Return a new hash for an algorithm, or nil if it is not supported.
+func newHash(algo string) hash.Hash {
+	switch algo {
+	case "SHA-1":
+		return sha1.New()
+	case "SHA-256":
+		return sha256.New()
+	case "SHA-512":
+		return sha512.New()
+	case "MD5":
+		return md5.New()
+	case "CRC32":
+		return crc32.NewIEEE()
+	}
+	return nil
+}
+
+// Return the HASH line for FEAT, marking the selected algorithm.
+func featHash(selected string) string {
+	algos := make([]string, len(hashAlgos))
+	for i, a := range hashAlgos {
+		if a == selected {
+			a += "*"
+		}
+		algos[i] = a
+	}
+	return "HASH " + strings.Join(algos, ";")
+}
+
+// Return the algorithm selected for HASH.
+func (s *fileSession) hashAlgo() string {
+	if s.hash == "" {
+		return defaultHash
+	}
+	return s.hash
+}
+
+// Handler for HASH.
+func (s *fileSession) hashFile(c *Command) error {
+	path := s.Path(c.Msg)
+	algo := s.hashAlgo()
+	start, n := s.rangeStart, int64(-1)
+	if s.rangeEnd >= 0 {
+		n = s.rangeEnd - start + 1 // End points of RANG are inclusive.
+	}
+	sum, end, err := s.checksum(path, algo, start, n)
+	if err == errNotFile {
+		return s.Reply(553, "Not a regular file.")
+	} else if isPermission(err) {
+		return s.Reply(550, "Insufficient permissions.")
+	} else if isNotExist(err) {
+		return s.Reply(550, "No such file.")
+	} else if err != nil {
+		return s.Reply(450, "Could not hash file.")
+	}
+	return s.Reply(213, "%s %d-%d %s %s", algo, start, end, sum, c.Msg)
+}
+
+// Handler for XMD5, XSHA1, XSHA256 and XCRC. These take an optional start and
+// end following the path. As with RANG, both are inclusive, so "0 4" is the
+// first five bytes.
+func (s *fileSession) hashLegacy(c *Command) error {
+	algo := map[string]string{
+		"XCRC":    "CRC32",
+		"XMD5":    "MD5",
+		"XSHA1":   "SHA-1",
+		"XSHA256": "SHA-256",
+	}[c.Cmd]
+	name, start, n := c.Msg, int64(0), int64(-1)
+	if args := strings.Split(c.Msg, " "); len(args) >= 3 {
+		a, aerr := strconv.ParseInt(args[len(args)-2], 10, 64)
+		z, zerr := strconv.ParseInt(args[len(args)-1], 10, 64)
+		if aerr == nil && zerr == nil {
+			name = strings.Join(args[:len(args)-2], " ")
+			start, n = a, z-a+1
+			if n < 0 {
+				n = 0
+			}
+		}
+	}
+	sum, _, err := s.checksum(s.Path(name), algo, start, n)
+	if err == errNotFile {
+		return s.Reply(550, "Not a regular file.")
+	} else if isPermission(err) {
+		return s.Reply(550, "Insufficient permissions.")
+	} else if isNotExist(err) {
+		return s.Reply(550, "No such file.")
+	} else if err != nil {
+		return s.Reply(550, "Could not hash file.")
+	}
+	return s.Reply(250, sum)
+}
+
+// Compute the hash of n bytes of a file from start, or to the end of the file
+// if n is negative. This returns the hash in hex and the offset of the last
+// byte hashed, or start if none were.
+func (s *fileSession) checksum(p, algo string, start, n int64) (string, int64, error) {
+	if err := s.access(AccessRead, p); err != nil {
+		return "", 0, err
+	}
+	stat, err := s.Stat(p)
+	if err != nil {
+		return "", 0, err
+	}
+	if !stat.Mode().IsRegular() {
+		return "", 0, errNotFile
+	}
+	size := stat.Size()
+	if start > size {
+		start = size
+	}
+	if n < 0 || n > size-start {
+		n = size - start
+	}
+	end := start + n - 1
+	if n == 0 {
+		end = start
+	}
+	if fs, ok := s.FileSystem.(HashFS); ok && start == 0 && n == size {
+		if sum, err := fs.Hash(p, algo); err == nil {
+			return hex.EncodeToString(sum), end, nil
+		}
+	}
+	file, err := s.Open(p)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	if start > 0 {
+		if _, err := file.Seek(start, io.SeekStart); err != nil {
+			return "", 0, err
+		}
+	}
+	h := newHash(algo)
+	if _, err := io.CopyN(h, file, n); err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), end, nil
+}
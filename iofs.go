@@ -0,0 +1,286 @@
+package ftp
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+)
+
+var errSeek = errors.New("seek not supported")
+
+// FromFS returns a read-only FileSystem serving fsys. Calls that would change
+// fsys fail with permission errors. Files that do not implement io.Seeker can
+// only seek forward.
+func FromFS(fsys fs.FS) FileSystem {
+	return &fromFS{fsys}
+}
+
+type fromFS struct {
+	fsys fs.FS
+}
+
+var (
+	_ LstatFS    = (*fromFS)(nil)
+	_ ReadlinkFS = (*fromFS)(nil)
+)
+
+// Create implements FileSystem.
+func (f *fromFS) Create(path string) (File, error) {
+	return nil, readOnly("create", path)
+}
+
+// Mkdir implements FileSystem.
+func (f *fromFS) Mkdir(path string) error {
+	return readOnly("mkdir", path)
+}
+
+// Open implements FileSystem.
+func (f *fromFS) Open(path string) (File, error) {
+	file, err := f.fsys.Open(fsName(path))
+	if err != nil {
+		return nil, err
+	}
+	return &fromFile{file: file, name: path}, nil
+}
+
+// Remove implements FileSystem.
+func (f *fromFS) Remove(path string) error {
+	return readOnly("remove", path)
+}
+
+// Rename implements FileSystem.
+func (f *fromFS) Rename(old, new string) error {
+	return readOnly("rename", old)
+}
+
+// Stat implements FileSystem.
+func (f *fromFS) Stat(path string) (os.FileInfo, error) {
+	return fs.Stat(f.fsys, fsName(path))
+}
+
+// Lstat implements LstatFS. If fsys cannot read links, this is like Stat.
+func (f *fromFS) Lstat(path string) (os.FileInfo, error) {
+	if l, ok := f.fsys.(readLinkFS); ok {
+		return l.Lstat(fsName(path))
+	}
+	return fs.Stat(f.fsys, fsName(path))
+}
+
+// Readlink implements ReadlinkFS.
+func (f *fromFS) Readlink(path string) (string, error) {
+	if l, ok := f.fsys.(readLinkFS); ok {
+		return l.ReadLink(fsName(path))
+	}
+	return "", &fs.PathError{Op: "readlink", Path: path, Err: fs.ErrInvalid}
+}
+
+// A readLinkFS is an fs.FS that can read links, like fs.ReadLinkFS of Go 1.25.
+type readLinkFS interface {
+	fs.FS
+	ReadLink(name string) (string, error)
+	Lstat(name string) (fs.FileInfo, error)
+}
+
+// Return the name of a FileSystem path in an fs.FS.
+func fsName(p string) string {
+	p = path.Join("/", p)
+	if p == "/" {
+		return "."
+	}
+	return p[1:]
+}
+
+func readOnly(op, path string) error {
+	return &fs.PathError{Op: op, Path: path, Err: fs.ErrPermission}
+}
+
+// A fromFile is a File of a fromFS.
+type fromFile struct {
+	file fs.File
+	name string
+	off  int64 // Offset, if file is not an io.Seeker.
+}
+
+// Read implements io.Reader.
+func (f *fromFile) Read(b []byte) (n int, err error) {
+	n, err = f.file.Read(b)
+	f.off += int64(n)
+	return n, err
+}
+
+// Write implements io.Writer.
+func (f *fromFile) Write(b []byte) (n int, err error) {
+	return 0, readOnly("write", f.name)
+}
+
+// Seek implements io.Seeker. If file is not an io.Seeker, this reads up to
+// the offset.
+func (f *fromFile) Seek(offset int64, whence int) (int64, error) {
+	if s, ok := f.file.(io.Seeker); ok {
+		return s.Seek(offset, whence)
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		fi, err := f.file.Stat()
+		if err != nil {
+			return f.off, err
+		}
+		offset += fi.Size()
+	}
+	if offset < f.off {
+		return f.off, &fs.PathError{Op: "seek", Path: f.name, Err: errSeek}
+	}
+	_, err := io.CopyN(io.Discard, f, offset-f.off)
+	if err == io.EOF {
+		err = nil // Like os.File, seeking past the end is allowed.
+		f.off = offset
+	}
+	return f.off, err
+}
+
+// Readdir implements File.
+func (f *fromFile) Readdir(n int) ([]os.FileInfo, error) {
+	dir, ok := f.file.(fs.ReadDirFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: errNotDir}
+	}
+	entries, err := dir.ReadDir(n)
+	list := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		fi, ierr := e.Info()
+		if isNotExist(ierr) {
+			continue // Removed since read.
+		} else if ierr != nil {
+			return list, ierr
+		}
+		list = append(list, fi)
+	}
+	return list, err
+}
+
+// Close implements io.Closer.
+func (f *fromFile) Close() error {
+	return f.file.Close()
+}
+
+// ToFS returns an fs.FS serving fsys. It implements fs.StatFS, fs.ReadDirFS and
+// fs.ReadFileFS.
+func ToFS(fsys FileSystem) fs.FS {
+	return &toFS{fsys}
+}
+
+type toFS struct {
+	fsys FileSystem
+}
+
+var (
+	_ fs.StatFS     = (*toFS)(nil)
+	_ fs.ReadDirFS  = (*toFS)(nil)
+	_ fs.ReadFileFS = (*toFS)(nil)
+)
+
+// Open implements fs.FS.
+func (f *toFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	file, err := f.fsys.Open(path.Join("/", name))
+	if err != nil {
+		return nil, toPathError("open", name, err)
+	}
+	return &toFile{file: file, fsys: f.fsys, name: name}, nil
+}
+
+// Stat implements fs.StatFS.
+func (f *toFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	fi, err := f.fsys.Stat(path.Join("/", name))
+	if err != nil {
+		return nil, toPathError("stat", name, err)
+	}
+	return fi, nil
+}
+
+// ReadDir implements fs.ReadDirFS.
+func (f *toFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	file, err := f.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	list, err := file.(*toFile).ReadDir(0)
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name() < list[j].Name()
+	})
+	return list, err
+}
+
+// ReadFile implements fs.ReadFileFS.
+func (f *toFS) ReadFile(name string) ([]byte, error) {
+	file, err := f.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	b, err := io.ReadAll(file)
+	if err != nil {
+		return b, toPathError("read", name, err)
+	}
+	return b, nil
+}
+
+// Return an error for name, as fs.FS methods are expected to.
+func toPathError(op, name string, err error) error {
+	if pe, ok := err.(*fs.PathError); ok {
+		err = pe.Err
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// A toFile is an fs.File of a toFS. It implements fs.ReadDirFile and
+// io.Seeker.
+type toFile struct {
+	file File
+	fsys FileSystem
+	name string
+}
+
+// Stat implements fs.File.
+func (f *toFile) Stat() (fs.FileInfo, error) {
+	if s, ok := f.file.(interface{ Stat() (os.FileInfo, error) }); ok {
+		return s.Stat()
+	}
+	return f.fsys.Stat(path.Join("/", f.name))
+}
+
+// Read implements fs.File.
+func (f *toFile) Read(b []byte) (int, error) {
+	return f.file.Read(b)
+}
+
+// Seek implements io.Seeker.
+func (f *toFile) Seek(offset int64, whence int) (int64, error) {
+	return f.file.Seek(offset, whence)
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (f *toFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	list, err := f.file.Readdir(n)
+	entries := make([]fs.DirEntry, len(list))
+	for i, fi := range list {
+		entries[i] = fs.FileInfoToDirEntry(fi)
+	}
+	return entries, err
+}
+
+// Close implements fs.File.
+func (f *toFile) Close() error {
+	return f.file.Close()
+}
@@ -5,21 +5,32 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"time"
 )
 
-// A Lister produces listing output similar to ls.
+// A Lister produces listing output similar to ls. If Cmd is "NLST", only
+// names are listed. If Cmd is "MLSD", machine-readable facts are listed as
+// described in RFC 3659.
 type Lister struct {
 	File
-	Cmd string
-	buf *bytes.Buffer
+	Cmd   string
+	Dir   string   // Dir is the path of File, used for MLSD.
+	Facts []string // Facts for MLSD. If nil, all supported facts.
+
+	buf      *bytes.Buffer
+	access   func(Access, string) bool
+	readlink func(string) string // Target of a link, or "" if unknown.
 }
 
 // Read implements io.Reader.
 func (l *Lister) Read(b []byte) (n int, err error) {
 	if l.buf == nil {
-		l.buf = new(bytes.Buffer)
-		l.WriteTo(l.buf)
+		buf := new(bytes.Buffer)
+		if _, err := l.WriteTo(buf); err != nil {
+			return 0, err
+		}
+		l.buf = buf
 	}
 	return l.buf.Read(b)
 }
@@ -34,7 +45,7 @@ func (l *Lister) WriteTo(w io.Writer) (n int64, err error) {
 		return 0, err
 	}
 
-	if l.Cmd != "NLST" {
+	if l.Cmd != "NLST" && l.Cmd != "MLSD" {
 		nn, err := fmt.Fprintln(w, "total", len(list))
 		n += int64(nn)
 		if err != nil {
@@ -54,21 +65,39 @@ func (l *Lister) WriteTo(w io.Writer) (n int64, err error) {
 }
 
 func (l *Lister) writeLine(w io.Writer, fi os.FileInfo) (n int, err error) {
-	if l.Cmd == "NLST" {
+	switch l.Cmd {
+	case "NLST":
 		return fmt.Fprintln(w, fi.Name())
+	case "MLSD":
+		facts := l.Facts
+		if facts == nil {
+			facts = mlstFacts
+		}
+		p := path.Join("/", l.Dir, fi.Name())
+		line := mlstLine(facts, p, fi, l.access)
+		return fmt.Fprintf(w, "%s %s\r\n", line, fi.Name())
 	}
-	return fmt.Fprintln(w, listLine(fi))
+	var target string
+	if fi.Mode()&os.ModeSymlink != 0 && l.readlink != nil {
+		target = l.readlink(path.Join(l.Dir, fi.Name()))
+	}
+	return fmt.Fprintln(w, listLine(fi, target))
 }
 
-func listLines(fi []os.FileInfo) []string {
+func listLines(dir string, fi []os.FileInfo, readlink func(string) string) []string {
 	l := make([]string, len(fi))
 	for i, fi := range fi {
-		l[i] = listLine(fi)
+		var target string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			target = readlink(path.Join(dir, fi.Name()))
+		}
+		l[i] = listLine(fi, target)
 	}
 	return l
 }
 
-func listLine(fi os.FileInfo) string {
+// Format a line of LIST output. The target of a link is shown if not "".
+func listLine(fi os.FileInfo, target string) string {
 	mode := fi.Mode()
 	nlinks := 1
 	user := "user"
@@ -76,6 +105,9 @@ func listLine(fi os.FileInfo) string {
 	size := fi.Size()
 	time := formatTime(fi.ModTime())
 	name := fi.Name()
+	if target != "" {
+		name += " -> " + target
+	}
 
 	return fmt.Sprintf("%10s %d %6s %6s %7d %12s %s",
 		mode, nlinks, user, group, size, time, name)
@@ -0,0 +1,535 @@
+package ftp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errIsDir = errors.New("is a directory")
+var errNotEmpty = errors.New("directory not empty")
+var errNotLink = errors.New("not a symbolic link")
+var errLinkLoop = errors.New("too many levels of symbolic links")
+
+// Maximum number of links followed when resolving a path.
+const maxLinks = 40
+
+// MemFileSystem is a FileSystem held in memory. It is safe for concurrent use.
+// The zero value is an empty file system.
+type MemFileSystem struct {
+	mu   sync.Mutex
+	root *memNode
+}
+
+var (
+	_ OpenFileFS   = (*MemFileSystem)(nil)
+	_ ChmodFS      = (*MemFileSystem)(nil)
+	_ SymlinkFS    = (*MemFileSystem)(nil)
+	_ ChtimesFS    = (*MemFileSystem)(nil)
+	_ CreateTimeFS = (*MemFileSystem)(nil)
+	_ LstatFS      = (*MemFileSystem)(nil)
+	_ ReadlinkFS   = (*MemFileSystem)(nil)
+	_ ChownFS      = (*MemFileSystem)(nil)
+	_ TruncateFS   = (*MemFileSystem)(nil)
+)
+
+// MemFileSys is returned by Sys of the os.FileInfo of a MemFileSystem file.
+type MemFileSys struct {
+	UID, GID   int       // Owner, as set by Chown.
+	CreateTime time.Time // CreateTime is when the file was created.
+}
+
+// A file, directory or link in a MemFileSystem.
+type memNode struct {
+	mode     os.FileMode
+	data     []byte
+	children map[string]*memNode // Entries of a directory.
+	target   string              // Target of a link.
+	mtime    time.Time
+	sys      MemFileSys
+}
+
+func newMemNode(mode os.FileMode) *memNode {
+	now := time.Now()
+	n := &memNode{mode: mode, mtime: now}
+	n.sys.CreateTime = now
+	if mode.IsDir() {
+		n.children = make(map[string]*memNode)
+	}
+	return n
+}
+
+func (n *memNode) info(name string) os.FileInfo {
+	sys := n.sys
+	return &memInfo{
+		stat: stat{name, int64(len(n.data)), n.mode, n.mtime},
+		sys:  &sys,
+	}
+}
+
+type memInfo struct {
+	stat
+	sys *MemFileSys
+}
+
+func (fi *memInfo) Sys() interface{} { return fi.sys }
+
+// Create implements FileSystem.
+func (f *MemFileSystem) Create(path string) (File, error) {
+	return f.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// OpenFile implements OpenFileFS.
+func (f *MemFileSystem) OpenFile(path string, flag int, perm os.FileMode) (File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dir, name, n, err := f.lookup(path, true)
+	if err != nil {
+		return nil, pathError("open", path, err)
+	}
+	write := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	switch {
+	case n == nil && flag&os.O_CREATE == 0:
+		return nil, pathError("open", path, os.ErrNotExist)
+	case n == nil:
+		n = newMemNode(perm & os.ModePerm)
+		dir.children[name] = n
+		dir.mtime = n.mtime
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, pathError("open", path, os.ErrExist)
+	case n.mode.IsDir() && write:
+		return nil, pathError("open", path, errIsDir)
+	case flag&os.O_TRUNC != 0 && write:
+		n.data, n.mtime = nil, time.Now()
+	}
+	if name == "" {
+		name = "/"
+	}
+	return &memFile{fs: f, n: n, name: name, flag: flag}, nil
+}
+
+// Open implements FileSystem.
+func (f *MemFileSystem) Open(path string) (File, error) {
+	return f.OpenFile(path, os.O_RDONLY, 0)
+}
+
+// Mkdir implements FileSystem.
+func (f *MemFileSystem) Mkdir(path string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dir, name, n, err := f.lookup(path, false)
+	if err != nil {
+		return pathError("mkdir", path, err)
+	} else if n != nil {
+		return pathError("mkdir", path, os.ErrExist)
+	}
+	n = newMemNode(os.ModeDir | 0755)
+	dir.children[name] = n
+	dir.mtime = n.mtime
+	return nil
+}
+
+// Remove implements FileSystem.
+func (f *MemFileSystem) Remove(path string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dir, name, n, err := f.node(path, false)
+	if err != nil {
+		return pathError("remove", path, err)
+	} else if dir == nil {
+		return pathError("remove", path, os.ErrPermission)
+	} else if len(n.children) > 0 {
+		return pathError("remove", path, errNotEmpty)
+	}
+	delete(dir.children, name)
+	dir.mtime = time.Now()
+	return nil
+}
+
+// Rename implements FileSystem. Files and directories may be moved to another
+// directory, replacing a file or empty directory of the same kind.
+func (f *MemFileSystem) Rename(old, new string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	odir, oname, n, err := f.node(old, false)
+	if err != nil {
+		return pathError("rename", old, err)
+	} else if odir == nil {
+		return pathError("rename", old, os.ErrPermission)
+	}
+	ndir, nname, dst, err := f.lookup(new, false)
+	if err != nil {
+		return pathError("rename", new, err)
+	} else if ndir == nil {
+		return pathError("rename", new, os.ErrExist)
+	}
+	switch {
+	case dst == n:
+		return nil
+	case n.contains(ndir):
+		return pathError("rename", new, os.ErrInvalid)
+	case dst == nil:
+	case dst.mode.IsDir() && !n.mode.IsDir():
+		return pathError("rename", new, errIsDir)
+	case !dst.mode.IsDir() && n.mode.IsDir():
+		return pathError("rename", new, errNotDir)
+	case len(dst.children) > 0:
+		return pathError("rename", new, errNotEmpty)
+	}
+	delete(odir.children, oname)
+	ndir.children[nname] = n
+	odir.mtime = time.Now()
+	ndir.mtime = odir.mtime
+	return nil
+}
+
+// Whether n is d or a directory containing it.
+func (n *memNode) contains(d *memNode) bool {
+	if n == d {
+		return true
+	}
+	for _, c := range n.children {
+		if c.mode.IsDir() && c.contains(d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Stat implements FileSystem.
+func (f *MemFileSystem) Stat(path string) (os.FileInfo, error) {
+	return f.stat("stat", path, true)
+}
+
+// Lstat implements LstatFS.
+func (f *MemFileSystem) Lstat(path string) (os.FileInfo, error) {
+	return f.stat("lstat", path, false)
+}
+
+func (f *MemFileSystem) stat(op, path string, follow bool) (os.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, name, n, err := f.node(path, follow)
+	if err != nil {
+		return nil, pathError(op, path, err)
+	}
+	if name == "" {
+		name = "/"
+	}
+	return n.info(name), nil
+}
+
+// Symlink implements SymlinkFS. The target is kept as given, and an absolute
+// target is a path within the MemFileSystem.
+func (f *MemFileSystem) Symlink(oldname, newname string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dir, name, n, err := f.lookup(newname, false)
+	if err != nil {
+		return pathError("symlink", newname, err)
+	} else if n != nil || dir == nil {
+		return pathError("symlink", newname, os.ErrExist)
+	}
+	n = newMemNode(os.ModeSymlink | 0777)
+	n.target = oldname
+	dir.children[name] = n
+	dir.mtime = n.mtime
+	return nil
+}
+
+// Readlink implements ReadlinkFS.
+func (f *MemFileSystem) Readlink(path string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, _, n, err := f.node(path, false)
+	if err != nil {
+		return "", pathError("readlink", path, err)
+	} else if n.mode&os.ModeSymlink == 0 {
+		return "", pathError("readlink", path, errNotLink)
+	}
+	return n.target, nil
+}
+
+// Chmod implements ChmodFS.
+func (f *MemFileSystem) Chmod(path string, mode os.FileMode) error {
+	return f.change("chmod", path, func(n *memNode) error {
+		n.mode = n.mode&os.ModeType | mode&^os.ModeType
+		return nil
+	})
+}
+
+// Chown implements ChownFS.
+func (f *MemFileSystem) Chown(path string, uid, gid int) error {
+	return f.change("chown", path, func(n *memNode) error {
+		if uid != -1 {
+			n.sys.UID = uid
+		}
+		if gid != -1 {
+			n.sys.GID = gid
+		}
+		return nil
+	})
+}
+
+// Chtimes implements ChtimesFS. Access times are not kept.
+func (f *MemFileSystem) Chtimes(path string, atime, mtime time.Time) error {
+	return f.change("chtimes", path, func(n *memNode) error {
+		if !mtime.IsZero() {
+			n.mtime = mtime
+		}
+		return nil
+	})
+}
+
+// SetCreateTime implements CreateTimeFS.
+func (f *MemFileSystem) SetCreateTime(path string, ctime time.Time) error {
+	return f.change("chtimes", path, func(n *memNode) error {
+		n.sys.CreateTime = ctime
+		return nil
+	})
+}
+
+// Truncate implements TruncateFS.
+func (f *MemFileSystem) Truncate(path string, size int64) error {
+	return f.change("truncate", path, func(n *memNode) error {
+		return n.truncate(size)
+	})
+}
+
+// Call fn with the node at path, following links.
+func (f *MemFileSystem) change(op, path string, fn func(n *memNode) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, _, n, err := f.node(path, true)
+	if err == nil {
+		err = fn(n)
+	}
+	if err != nil {
+		return pathError(op, path, err)
+	}
+	return nil
+}
+
+func (n *memNode) truncate(size int64) error {
+	if n.mode.IsDir() {
+		return errIsDir
+	} else if size < 0 {
+		return os.ErrInvalid
+	}
+	if size <= int64(len(n.data)) {
+		n.data = n.data[:size]
+	} else {
+		n.data = append(n.data, make([]byte, size-int64(len(n.data)))...)
+	}
+	n.mtime = time.Now()
+	return nil
+}
+
+// Like lookup, but the node must exist.
+func (f *MemFileSystem) node(p string, follow bool) (*memNode, string, *memNode, error) {
+	dir, name, n, err := f.lookup(p, follow)
+	if err == nil && n == nil {
+		err = os.ErrNotExist
+	}
+	return dir, name, n, err
+}
+
+// Find the directory containing p and the name of p in it, and the node at p
+// or nil if there is none. Links are followed, except at the end of p unless
+// follow is set. For the root, the directory is nil and the name is "".
+func (f *MemFileSystem) lookup(p string, follow bool) (*memNode, string, *memNode, error) {
+	if f.root == nil {
+		f.root = newMemNode(os.ModeDir | 0755)
+	}
+	parts := splitPath(p)
+	dir, cur := f.root, "/"
+	links := 0
+	for i := 0; i < len(parts); i++ {
+		name := parts[i]
+		n := dir.children[name]
+		last := i == len(parts)-1
+		if n != nil && n.mode&os.ModeSymlink != 0 && (!last || follow) {
+			if links++; links > maxLinks {
+				return nil, "", nil, errLinkLoop
+			}
+			target := n.target
+			if !path.IsAbs(target) {
+				target = path.Join(cur, target)
+			}
+			parts = append(splitPath(target), parts[i+1:]...)
+			dir, cur, i = f.root, "/", -1
+			continue
+		}
+		if last {
+			return dir, name, n, nil
+		} else if n == nil {
+			return nil, "", nil, os.ErrNotExist
+		} else if !n.mode.IsDir() {
+			return nil, "", nil, errNotDir
+		}
+		dir, cur = n, path.Join(cur, name)
+	}
+	return nil, "", f.root, nil
+}
+
+// Split a path into its names, after cleaning it.
+func splitPath(p string) []string {
+	p = path.Join("/", p)
+	if p == "/" {
+		return nil
+	}
+	return strings.Split(p[1:], "/")
+}
+
+func pathError(op, path string, err error) error {
+	return &os.PathError{Op: op, Path: path, Err: err}
+}
+
+// A memFile is an open file of a MemFileSystem.
+type memFile struct {
+	fs     *MemFileSystem
+	n      *memNode
+	name   string
+	flag   int
+	off    int64
+	list   []os.FileInfo // Directory entries not yet read.
+	listed bool          // Whether list has been read.
+	closed bool
+}
+
+// Read implements io.Reader.
+func (f *memFile) Read(b []byte) (n int, err error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("read", os.O_RDONLY); err != nil {
+		return 0, err
+	}
+	if f.off >= int64(len(f.n.data)) {
+		return 0, io.EOF
+	}
+	n = copy(b, f.n.data[f.off:])
+	f.off += int64(n)
+	return n, nil
+}
+
+// Write implements io.Writer.
+func (f *memFile) Write(b []byte) (n int, err error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("write", os.O_WRONLY); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.off = int64(len(f.n.data))
+	}
+	if end := f.off + int64(len(b)); end > int64(len(f.n.data)) {
+		f.n.truncate(end)
+	}
+	n = copy(f.n.data[f.off:], b)
+	f.off += int64(n)
+	f.n.mtime = time.Now()
+	return n, nil
+}
+
+// Check that the file is open for reading (os.O_RDONLY) or writing
+// (os.O_WRONLY), and not a directory.
+func (f *memFile) check(op string, access int) error {
+	if f.closed {
+		return pathError(op, f.name, os.ErrClosed)
+	} else if f.n.mode.IsDir() {
+		return pathError(op, f.name, errIsDir)
+	}
+	mode := f.flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+	if mode != os.O_RDWR && mode != access {
+		return pathError(op, f.name, os.ErrPermission)
+	}
+	return nil
+}
+
+// Seek implements io.Seeker.
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return 0, pathError("seek", f.name, os.ErrClosed)
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += int64(len(f.n.data))
+	}
+	if offset < 0 {
+		return 0, pathError("seek", f.name, os.ErrInvalid)
+	}
+	f.off = offset
+	return offset, nil
+}
+
+// Truncate changes the size of the file.
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("truncate", os.O_WRONLY); err != nil {
+		return err
+	}
+	if err := f.n.truncate(size); err != nil {
+		return pathError("truncate", f.name, err)
+	}
+	return nil
+}
+
+// Stat returns the os.FileInfo of the file.
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return nil, pathError("stat", f.name, os.ErrClosed)
+	}
+	return f.n.info(f.name), nil
+}
+
+// Readdir implements File.
+func (f *memFile) Readdir(n int) ([]os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return nil, pathError("readdir", f.name, os.ErrClosed)
+	} else if !f.n.mode.IsDir() {
+		return nil, pathError("readdir", f.name, errNotDir)
+	}
+	if !f.listed {
+		for name, c := range f.n.children {
+			f.list = append(f.list, c.info(name))
+		}
+		sort.Slice(f.list, func(i, j int) bool {
+			return f.list[i].Name() < f.list[j].Name()
+		})
+		f.listed = true
+	}
+	if n <= 0 || n > len(f.list) {
+		if n > 0 && len(f.list) == 0 {
+			return nil, io.EOF
+		}
+		n = len(f.list)
+	}
+	list := f.list[:n:n]
+	f.list = f.list[n:]
+	return list, nil
+}
+
+// Close implements io.Closer.
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return pathError("close", f.name, os.ErrClosed)
+	}
+	f.closed = true
+	return nil
+}
@@ -0,0 +1,102 @@
+package ftp
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Return the facts MFF can modify on the session's file system.
+func (s *fileSession) mffFacts() []string {
+	var facts []string
+	if _, ok := s.FileSystem.(ChtimesFS); ok {
+		facts = append(facts, "Modify")
+	}
+	if _, ok := s.FileSystem.(CreateTimeFS); ok {
+		facts = append(facts, "Create")
+	}
+	if _, ok := s.FileSystem.(ChmodFS); ok {
+		facts = append(facts, "UNIX.mode")
+	}
+	return facts
+}
+
+// Handler for MFMT, MFCT and MFF. MFMT and MFCT are treated as MFF with a
+// single fact.
+func (s *fileSession) modifyFacts(c *Command) error {
+	args := strings.SplitN(c.Msg, " ", 2)
+	if len(args) < 2 || args[1] == "" {
+		return s.Reply(501, "Invalid syntax.")
+	}
+	facts, path := args[0], s.Path(args[1])
+	switch c.Cmd {
+	case "MFMT":
+		facts = "Modify=" + facts
+	case "MFCT":
+		facts = "Create=" + facts
+	}
+	if err := s.access(AccessWrite, path); err != nil {
+		return s.Reply(550, "Insufficient permissions.")
+	}
+
+	var set []string
+	for _, fact := range strings.Split(facts, ";") {
+		if fact == "" {
+			continue
+		}
+		kv := strings.SplitN(fact, "=", 2)
+		if len(kv) != 2 {
+			return s.Reply(501, "Invalid syntax.")
+		}
+		err := errNotSupported
+		switch strings.ToLower(kv[0]) {
+		case "modify":
+			t, perr := parseTime(kv[1])
+			if perr != nil {
+				return s.Reply(501, "Invalid time.")
+			}
+			if fs, ok := s.FileSystem.(ChtimesFS); ok {
+				err = fs.Chtimes(path, time.Time{}, t)
+			}
+		case "create":
+			t, perr := parseTime(kv[1])
+			if perr != nil {
+				return s.Reply(501, "Invalid time.")
+			}
+			if fs, ok := s.FileSystem.(CreateTimeFS); ok {
+				err = fs.SetCreateTime(path, t)
+			}
+		case "unix.mode":
+			mode, perr := strconv.ParseUint(kv[1], 8, 32)
+			if perr != nil || mode > 07777 {
+				return s.Reply(501, "Invalid mode.")
+			}
+			if fs, ok := s.FileSystem.(ChmodFS); ok {
+				err = fs.Chmod(path, unixMode(mode))
+			}
+		}
+		if err == errNotSupported {
+			if c.Cmd != "MFF" {
+				return s.Reply(502, "Not supported by file system.")
+			}
+			return s.Reply(504, "Fact %s cannot be modified.", kv[0])
+		} else if isPermission(err) {
+			return s.Reply(550, "Insufficient permissions.")
+		} else if isNotExist(err) {
+			return s.Reply(550, "No such file or directory.")
+		} else if err != nil {
+			return s.Reply(550, "Could not modify %s.", kv[0])
+		}
+		set = append(set, fact+";")
+	}
+	return s.Reply(213, "%s %s", strings.Join(set, ""), args[1])
+}
+
+// Parse a time in the format used by MDTM, with optional fractional seconds.
+func parseTime(s string) (time.Time, error) {
+	layout := mdtmFormat
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		layout += "." + strings.Repeat("9", len(s)-i-1)
+	}
+	return time.ParseInLocation(layout, s, time.UTC)
+}
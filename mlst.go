@@ -0,0 +1,109 @@
+package ftp
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strings"
+)
+
+// Facts supported by MLST and MLSD, in the order they are given.
+var mlstFacts = []string{"type", "size", "modify", "perm", "unique", "unix.mode"}
+
+// Select supported facts from a list given to OPTS MLST.
+func selectFacts(list string) []string {
+	facts := []string{}
+	for _, f := range strings.Split(strings.ToLower(list), ";") {
+		for _, ff := range mlstFacts {
+			if f == ff {
+				facts = append(facts, f)
+			}
+		}
+	}
+	return facts
+}
+
+// Return the MLST line for FEAT, marking enabled facts.
+func featMLST(enabled []string) string {
+	s := "MLST "
+	for _, f := range mlstFacts {
+		s += f
+		for _, e := range enabled {
+			if e == f {
+				s += "*"
+			}
+		}
+		s += ";"
+	}
+	return s
+}
+
+// Return the facts of a file at path p, formatted for MLST and MLSD. If
+// access is not nil, the perm fact is restricted by it.
+func mlstLine(facts []string, p string, fi os.FileInfo, access func(Access, string) bool) string {
+	var s string
+	for _, f := range facts {
+		switch f {
+		case "type":
+			s += "type=" + mlstType(fi) + ";"
+		case "size":
+			if !fi.IsDir() {
+				s += fmt.Sprintf("size=%d;", fi.Size())
+			}
+		case "modify":
+			s += "modify=" + fi.ModTime().UTC().Format(mdtmFormat) + ";"
+		case "perm":
+			s += "perm=" + mlstPerm(p, fi, access) + ";"
+		case "unique":
+			h := fnv.New64a()
+			h.Write([]byte(p))
+			s += fmt.Sprintf("unique=%x;", h.Sum64())
+		case "unix.mode":
+			s += fmt.Sprintf("unix.mode=0%o;", fi.Mode().Perm())
+		}
+	}
+	return s
+}
+
+func mlstType(fi os.FileInfo) string {
+	mode := fi.Mode()
+	switch {
+	case mode.IsDir():
+		return "dir"
+	case mode.IsRegular():
+		return "file"
+	case mode&os.ModeSymlink != 0:
+		return "OS.unix=symlink"
+	case mode&os.ModeNamedPipe != 0:
+		return "OS.unix=fifo"
+	case mode&os.ModeSocket != 0:
+		return "OS.unix=socket"
+	}
+	return "OS.unix=device"
+}
+
+// Return the perm fact of a file, based on the owner bits of its mode.
+func mlstPerm(p string, fi os.FileInfo, access func(Access, string) bool) string {
+	mode := fi.Mode().Perm()
+	r, w, x := mode&0400 != 0, mode&0200 != 0, mode&0100 != 0
+	var b []byte
+	add := func(c byte, ok bool, op Access) {
+		if ok && (access == nil || access(op, p)) {
+			b = append(b, c)
+		}
+	}
+	if fi.IsDir() {
+		add('e', x, AccessList)
+		add('l', r, AccessList)
+		add('c', w, AccessWrite)
+		add('m', w, AccessMkdir)
+		add('p', w, AccessDelete)
+	} else {
+		add('r', r, AccessRead)
+		add('w', w, AccessWrite)
+		add('a', w, AccessAppend)
+	}
+	add('d', w, AccessDelete)
+	add('f', w, AccessRename)
+	return string(b)
+}
@@ -0,0 +1,68 @@
+package ftp
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// An UploadPolicy can be used with a FileHandler to restrict uploads. Name
+// rules are checked against the base name of uploaded and renamed files.
+type UploadPolicy struct {
+	Allow     []string // Name patterns to allow. If nil, allow all.
+	Deny      []string // Name patterns to deny.
+	Forbidden string   // Characters forbidden in names.
+	MaxSize   int64    // Maximum file size in bytes, or 0 for no limit.
+}
+
+// A PolicyError is returned when an upload violates an UploadPolicy.
+type PolicyError struct {
+	Rule string // Description of the rule that failed.
+
+	code int // Reply code.
+}
+
+// Error implements error.
+func (e *PolicyError) Error() string {
+	return "denied by upload policy: " + e.Rule
+}
+
+// CheckName checks whether a file with the given path may be uploaded. Patterns
+// have the syntax of path.Match and are matched case-insensitively.
+func (p *UploadPolicy) CheckName(name string) error {
+	name = path.Base(name)
+	if i := strings.IndexAny(name, p.Forbidden); i >= 0 {
+		r, _ := utf8.DecodeRuneInString(name[i:])
+		return p.nameError("name contains forbidden character %q", r)
+	}
+	for _, pat := range p.Deny {
+		if matchFold(pat, name) {
+			return p.nameError("name matches denied pattern %q", pat)
+		}
+	}
+	if p.Allow == nil {
+		return nil
+	}
+	for _, pat := range p.Allow {
+		if matchFold(pat, name) {
+			return nil
+		}
+	}
+	return p.nameError("name does not match an allowed pattern")
+}
+
+func (p *UploadPolicy) nameError(format string, args ...interface{}) error {
+	return &PolicyError{Rule: fmt.Sprintf(format, args...), code: 553}
+}
+
+func (p *UploadPolicy) sizeError() error {
+	rule := fmt.Sprintf("file exceeds maximum size of %d bytes", p.MaxSize)
+	return &PolicyError{Rule: rule, code: 552}
+}
+
+// Match a name against a pattern, ignoring case.
+func matchFold(pattern, name string) bool {
+	ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(name))
+	return ok
+}
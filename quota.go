@@ -0,0 +1,340 @@
+package ftp
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// Whether an upload was refused for exceeding a quota or the upload policy.
+func isRefused(err error) bool {
+	_, ok := err.(*PolicyError)
+	return ok || err == errQuotaExceeded
+}
+
+// A Quota limits the storage used by a user. Zero fields mean no limit.
+type Quota struct {
+	Bytes int64 // Bytes is the maximum total size of files.
+	Files int64 // Files is the maximum number of files.
+}
+
+// Usage is the storage used by a user.
+type Usage struct {
+	Bytes int64 // Bytes is the total size of files.
+	Files int64 // Files is the number of files.
+}
+
+// A Ledger records usage so that it survives restarts.
+type Ledger interface {
+	// Load the usage of user. This returns an error satisfying os.IsNotExist
+	// if no usage has been recorded, in which case the user's file system is
+	// scanned.
+	Load(user string) (Usage, error)
+
+	// Store the usage of user.
+	Store(user string, u Usage) error
+}
+
+// FileLedger is a Ledger that persists usage as JSON in a local file.
+type FileLedger struct {
+	Path string // Path of the file.
+
+	m sync.Mutex
+}
+
+var _ Ledger = (*FileLedger)(nil)
+
+// Load implements Ledger.
+func (l *FileLedger) Load(user string) (Usage, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	m, err := l.read()
+	if err != nil {
+		return Usage{}, err
+	}
+	u, ok := m[user]
+	if !ok {
+		return Usage{}, os.ErrNotExist
+	}
+	return u, nil
+}
+
+// Store implements Ledger.
+func (l *FileLedger) Store(user string, u Usage) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	m, err := l.read()
+	if isNotExist(err) {
+		m = make(map[string]Usage)
+	} else if err != nil {
+		return err
+	}
+	m[user] = u
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := l.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.Path)
+}
+
+func (l *FileLedger) read() (map[string]Usage, error) {
+	b, err := ioutil.ReadFile(l.Path)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]Usage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Usage shared between sessions of a FileHandler, by user.
+type quotas struct {
+	sync.Mutex
+	m       map[string]*Usage
+	charged map[string]int64 // Bytes of uploads in progress.
+}
+
+// Load the user's usage if they have a quota. This consults the ledger and
+// falls back to scanning the session's file system.
+func (s *fileSession) loadUsage() error {
+	if _, ok := s.quota(); !ok {
+		return nil
+	}
+	q := &s.quotas
+	q.Lock()
+	defer q.Unlock()
+	if q.m[s.User] != nil {
+		return nil
+	}
+	var u Usage
+	var err error
+	if s.Ledger != nil {
+		u, err = s.Ledger.Load(s.User)
+	}
+	if s.Ledger == nil || isNotExist(err) {
+		u, err = scanUsage(s.FileSystem, "/")
+		if err == nil && s.Ledger != nil {
+			err = s.Ledger.Store(s.User, u)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if q.m == nil {
+		q.m = make(map[string]*Usage)
+	}
+	q.m[s.User] = &u
+	return nil
+}
+
+// Return the user's quota, if they have one.
+func (s *fileSession) quota() (Quota, bool) {
+	if s.settings == nil {
+		return Quota{}, false
+	}
+	q := s.settings.Quota
+	return q, q.Bytes > 0 || q.Files > 0
+}
+
+// Return the user's usage, including uploads in progress.
+func (s *fileSession) usage() Usage {
+	q := &s.quotas
+	q.Lock()
+	defer q.Unlock()
+	if u := q.m[s.User]; u != nil {
+		return Usage{u.Bytes + q.charged[s.User], u.Files}
+	}
+	return Usage{}
+}
+
+// Add to the user's usage and record it in the ledger. This also releases
+// bytes charged by an upload.
+func (s *fileSession) addUsage(bytes, files, charged int64) error {
+	if _, ok := s.quota(); !ok || bytes == 0 && files == 0 && charged == 0 {
+		return nil
+	}
+	q := &s.quotas
+	q.Lock()
+	defer q.Unlock()
+	u := q.m[s.User]
+	if u == nil {
+		return nil
+	}
+	if charged != 0 {
+		q.charged[s.User] -= charged
+	}
+	if bytes == 0 && files == 0 {
+		return nil
+	}
+	u.Bytes += bytes
+	u.Files += files
+	if s.Ledger != nil {
+		return s.Ledger.Store(s.User, *u)
+	}
+	return nil
+}
+
+// Check whether the user may create another file.
+func (s *fileSession) canCreate() bool {
+	q, ok := s.quota()
+	return !ok || q.Files <= 0 || s.usage().Files < q.Files
+}
+
+// Stat a file for updateUsage, returning nil if quotas are not in use or p is
+// not a file.
+func (s *fileSession) statUsage(p string) os.FileInfo {
+	if _, ok := s.quota(); !ok {
+		return nil
+	}
+	if fi, err := s.Stat(p); err == nil && !fi.IsDir() {
+		return fi
+	}
+	return nil
+}
+
+// Update the user's usage after p has changed, given the result of statUsage
+// before the change.
+func (s *fileSession) updateUsage(p string, old os.FileInfo) error {
+	return s.settleUsage(p, old, 0)
+}
+
+// Like updateUsage, but also release bytes charged while p was uploaded.
+func (s *fileSession) settleUsage(p string, old os.FileInfo, charged int64) error {
+	if _, ok := s.quota(); !ok {
+		return nil
+	}
+	var bytes, files int64
+	if old != nil {
+		bytes -= old.Size()
+		files--
+	}
+	if fi, err := s.Stat(p); err == nil && !fi.IsDir() {
+		bytes += fi.Size()
+		files++
+	}
+	return s.addUsage(bytes, files, charged)
+}
+
+// Return the number of bytes the user may still store, or -1 if unlimited.
+func (s *fileSession) available() int64 {
+	q, ok := s.quota()
+	if !ok || q.Bytes <= 0 {
+		return -1
+	}
+	if n := q.Bytes - s.usage().Bytes; n > 0 {
+		return n
+	}
+	return 0
+}
+
+// Sum the sizes of files under p.
+func scanUsage(fs FileSystem, p string) (u Usage, err error) {
+	err = walk(fs, p, func(p string, fi os.FileInfo) error {
+		if !fi.IsDir() {
+			u.Bytes += fi.Size()
+			u.Files++
+		}
+		return nil
+	})
+	return u, err
+}
+
+// Charge up to n bytes of an upload in progress to the user's usage, returning
+// the number charged. The usage may not exceed the byte quota. A negative n
+// releases bytes.
+func (s *fileSession) charge(n int64) int64 {
+	quota, _ := s.quota()
+	q := &s.quotas
+	q.Lock()
+	defer q.Unlock()
+	u := q.m[s.User]
+	if u == nil {
+		return n
+	}
+	if avail := quota.Bytes - u.Bytes - q.charged[s.User]; n > avail {
+		n = avail
+		if n < 0 {
+			n = 0
+		}
+	}
+	if q.charged == nil {
+		q.charged = make(map[string]int64)
+	}
+	q.charged[s.User] += n
+	return n
+}
+
+// A quotaWriter charges bytes to the user's usage as they are written, so that
+// concurrent uploads share the quota. It fails with errQuotaExceeded once the
+// quota is used up. The first free bytes replace stored data, and are not
+// charged.
+type quotaWriter struct {
+	w       io.Writer
+	s       *fileSession
+	free    int64 // Bytes that may still be written without charge.
+	charged int64 // Bytes charged so far.
+}
+
+// Write implements io.Writer.
+func (q *quotaWriter) Write(b []byte) (n int, err error) {
+	free := q.free
+	if free > int64(len(b)) {
+		free = int64(len(b))
+	}
+	got := q.s.charge(int64(len(b)) - free)
+	n, err = q.w.Write(b[:free+got])
+	used := int64(n) - free
+	if used < 0 {
+		q.free -= int64(n)
+		used = 0
+	} else {
+		q.free -= free
+	}
+	q.s.charge(used - got) // Release what was not written.
+	q.charged += used
+	if err == nil && int64(n) < int64(len(b)) {
+		err = errQuotaExceeded
+	}
+	return n, err
+}
+
+// Return the bytes charged by q, which may be nil.
+func (q *quotaWriter) total() int64 {
+	if q == nil {
+		return 0
+	}
+	return q.charged
+}
+
+// A limitWriter fails with err once more than n bytes would be written.
+type limitWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+// Write implements io.Writer.
+func (l *limitWriter) Write(b []byte) (n int, err error) {
+	if int64(len(b)) > l.n {
+		n, err = l.w.Write(b[:l.n])
+		l.n -= int64(n)
+		if err == nil {
+			err = l.err
+		}
+		return n, err
+	}
+	n, err = l.w.Write(b)
+	l.n -= int64(n)
+	return n, err
+}
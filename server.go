@@ -1,7 +1,9 @@
 package ftp
 
 import (
+	"compress/zlib"
 	"crypto/tls"
+	"log"
 	"net"
 	"net/textproto"
 )
@@ -30,6 +32,20 @@ type Server struct {
 	Listener Listener    // Listener for passive connections.
 	Handler  Handler     // Handler for commands.
 	Debug    bool        // Debug prints control channel traffic.
+	CodePage *CodePage   // CodePage for TYPE E. Defaults to CodePage037.
+
+	// ErrorLog logs errors that do not end a session. If nil, the standard
+	// logger of the log package is used.
+	ErrorLog *log.Logger
+}
+
+// Log an error through the server's error log.
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
 }
 
 // Listen through the server's listener.
@@ -91,6 +107,7 @@ func (s *Server) ServeFTP(c net.Conn) {
 		Addr:   c.RemoteAddr(),
 		Server: s,
 		conn:   textproto.NewConn(c),
+		level:  zlib.DefaultCompression,
 	}
 	if a, ok := c.LocalAddr().(*net.TCPAddr); ok {
 		ss.host = a.IP.String()
@@ -1,11 +1,13 @@
 package ftp
 
 import (
+	"compress/zlib"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"net/textproto"
+	"sync"
 )
 
 var errSessionClosed = errors.New("session is closed")
@@ -22,6 +24,18 @@ type Session struct {
 	conn    *textproto.Conn
 	cmd     *Command
 	greeted bool
+
+	in    chan incoming // Commands read from the control channel.
+	done  chan struct{} // Closed when the session is closed.
+	queue []*Command    // Commands to handle before reading more.
+	wm    sync.Mutex    // Guards writes to the control channel.
+	level int           // Compression level for MODE Z.
+}
+
+// A command read from the control channel, or an error.
+type incoming struct {
+	cmd *Command
+	err error
 }
 
 // Command reads the next command, or returns the current command if it has
@@ -39,15 +53,52 @@ func (s *Session) Command() (*Command, error) {
 	if s.cmd != nil {
 		return s.cmd, nil
 	}
-	cmd := new(Command)
-	if err := cmd.Decode(&s.conn.Reader); err != nil {
-		return nil, err
+	if len(s.queue) > 0 {
+		s.cmd, s.queue = s.queue[0], s.queue[1:]
+		return s.cmd, nil
 	}
-	s.cmd = cmd
-	if s.Server.Debug {
-		fmt.Println("<", cmd)
+	in, ok := <-s.incoming()
+	if !ok {
+		return nil, errSessionClosed
+	}
+	if in.err != nil {
+		return nil, in.err
+	}
+	s.cmd = in.cmd
+	return s.cmd, nil
+}
+
+// Return a channel of commands read from the control channel. Commands are
+// read on another goroutine so that a handler can receive commands while
+// doing other work, such as transferring data. The channel is closed after
+// an error is received on it.
+func (s *Session) incoming() <-chan incoming {
+	if s.in == nil {
+		s.in = make(chan incoming)
+		s.done = make(chan struct{})
+		go s.read(s.conn, s.in, s.done)
+	}
+	return s.in
+}
+
+// Read commands from conn into in, until an error or done is closed.
+func (s *Session) read(conn *textproto.Conn, in chan<- incoming, done <-chan struct{}) {
+	defer close(in)
+	for {
+		cmd := new(Command)
+		err := cmd.Decode(&conn.Reader)
+		if err == nil && s.Server.Debug {
+			fmt.Println("<", cmd)
+		}
+		select {
+		case in <- incoming{cmd, err}:
+		case <-done:
+			return
+		}
+		if err != nil {
+			return
+		}
 	}
-	return cmd, nil
 }
 
 // Reply sends a reply. This must be called with a non-intermediate reply code
@@ -63,14 +114,7 @@ func (s *Session) Reply(code int, msg string, args ...interface{}) error {
 	if s.cmd == nil && s.greeted {
 		return errors.New("no command to reply to")
 	}
-	m := Reply{code, msg}
-	if s.Server.Debug {
-		fmt.Println(">", m)
-	}
-	if err := m.Encode(&s.conn.Writer); err != nil {
-		return err
-	}
-	if err := s.conn.W.Flush(); err != nil {
+	if err := s.send(code, msg); err != nil {
 		return err
 	}
 	if code < 200 {
@@ -88,6 +132,21 @@ func (s *Session) Reply(code int, msg string, args ...interface{}) error {
 	return nil
 }
 
+// Send a reply without affecting the current command. This is safe to call
+// concurrently with Reply.
+func (s *Session) send(code int, msg string) error {
+	s.wm.Lock()
+	defer s.wm.Unlock()
+	m := Reply{code, msg}
+	if s.Server.Debug {
+		fmt.Println(">", m)
+	}
+	if err := m.Encode(&s.conn.Writer); err != nil {
+		return err
+	}
+	return s.conn.W.Flush()
+}
+
 // Close the session. This will send a default goodbye reply if one has not
 // been sent in response to a QUIT.
 func (s *Session) Close() error {
@@ -100,6 +159,9 @@ func (s *Session) Close() error {
 	s.CloseData()
 	err := s.conn.Close()
 	s.conn = nil
+	if s.done != nil {
+		close(s.done)
+	}
 	return err
 }
 
@@ -118,7 +180,7 @@ func (s *Session) Active(addr net.Addr) error {
 		c = tls.Server(c, s.TLS)
 	}
 	s.Data = ActiveConn(c)
-	s.Data.Type(s.Type)
+	s.initData()
 	return nil
 }
 
@@ -138,10 +200,19 @@ func (s *Session) Passive(nw string) error {
 		li = tls.NewListener(li, s.TLS)
 	}
 	s.Data = PassiveConn(li)
-	s.Data.Type(s.Type)
+	s.initData()
 	return nil
 }
 
+// Set the transfer parameters of a new data channel.
+func (s *Session) initData() {
+	s.Data.Type(s.Type)
+	s.Data.Mode(s.Mode)
+	s.Data.Level(s.level)
+	s.Data.Structure(s.Stru)
+	s.Data.CodePage(s.Server.CodePage)
+}
+
 // SetType sets s.Type as well as the type of any existing data channel.
 func (s *Session) SetType(t string) error {
 	switch t {
@@ -151,8 +222,10 @@ func (s *Session) SetType(t string) error {
 		t = "A"
 	case "AT", "AC":
 		return errors.New("ASCII print mode is not supported.")
-	case "E", "EN", "ET", "EC":
-		return errors.New("EBCDIC mode is not supported.")
+	case "E", "EN":
+		t = "E"
+	case "ET", "EC":
+		return errors.New("EBCDIC print mode is not supported.")
 	default:
 		return errors.New("Unrecognized type.")
 	}
@@ -163,12 +236,27 @@ func (s *Session) SetType(t string) error {
 	return nil
 }
 
+// SetStructure sets s.Stru as well as the structure of any existing data
+// channel.
+func (s *Session) SetStructure(st string) error {
+	switch st {
+	case "F", "R":
+	case "P":
+		return errors.New("Page structure is not supported.")
+	default:
+		return errors.New("Unrecognized structure.")
+	}
+	s.Stru = st
+	if s.Data != nil {
+		s.Data.Structure(st)
+	}
+	return nil
+}
+
 // SetMode sets s.Mode as well as the mode of any existing data channel.
 func (s *Session) SetMode(m string) error {
 	switch m {
-	case "S":
-	case "B":
-		return errors.New("Block mode is not supported.")
+	case "S", "B", "Z":
 	case "C":
 		return errors.New("Compressed mode is not supported.")
 	default:
@@ -180,3 +268,16 @@ func (s *Session) SetMode(m string) error {
 	}
 	return nil
 }
+
+// SetLevel sets the compression level of MODE Z, as for compress/zlib, for
+// this and any existing data channel.
+func (s *Session) SetLevel(n int) error {
+	if n < zlib.DefaultCompression || n > zlib.BestCompression {
+		return errors.New("Invalid compression level.")
+	}
+	s.level = n
+	if s.Data != nil {
+		s.Data.Level(n)
+	}
+	return nil
+}
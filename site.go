@@ -0,0 +1,285 @@
+package ftp
+
+import (
+	"os"
+	pathpkg "path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A SiteFunc handles a SITE command for a FileHandler. It must reply to the
+// command. Returning an error closes the session.
+type SiteFunc func(r *SiteRequest) error
+
+// A SiteRequest is a SITE command received by a FileHandler.
+type SiteRequest struct {
+	*Session
+	FileSystem FileSystem // FileSystem of the session.
+	Cmd        string     // Cmd is the SITE command in upper case.
+	Args       string     // Args following the SITE command.
+
+	fs *fileSession
+}
+
+// Allow returns whether the user may perform op on path, which is relative to
+// the working directory, according to the FileHandler's ACL.
+func (r *SiteRequest) Allow(op Access, path string) bool {
+	return r.fs.access(op, r.Path(path)) == nil
+}
+
+// Built-in SITE commands.
+var siteCommands = map[string]func(*fileSession, string) error{
+	"CHMOD":   (*fileSession).siteChmod,
+	"CHOWN":   (*fileSession).siteChown,
+	"QUOTA":   (*fileSession).siteQuota,
+	"SYMLINK": (*fileSession).siteSymlink,
+	"UMASK":   (*fileSession).siteUmask,
+	"UTIME":   (*fileSession).siteUtime,
+}
+
+// Handler for SITE.
+func (s *fileSession) site(c *Command) error {
+	args := strings.SplitN(c.Msg, " ", 2)
+	cmd := strings.ToUpper(args[0])
+	var msg string
+	if len(args) > 1 {
+		msg = args[1]
+	}
+	if fn := s.Site[cmd]; fn != nil {
+		return fn(&SiteRequest{
+			Session:    s.Session,
+			FileSystem: s.FileSystem,
+			Cmd:        cmd,
+			Args:       msg,
+			fs:         s,
+		})
+	}
+	if cmd == "HELP" {
+		return s.siteHelp()
+	}
+	fn := siteCommands[cmd]
+	if fn == nil {
+		return s.Reply(500, "Unknown SITE command.")
+	}
+	err := fn(s, msg)
+	if err == errNotSupported {
+		return s.Reply(502, "Not supported by file system.")
+	} else if err == ErrInvalidSyntax {
+		return s.Reply(501, "Invalid syntax.")
+	} else if isPermission(err) {
+		return s.Reply(550, "Insufficient permissions.")
+	} else if isNotExist(err) {
+		return s.Reply(550, "No such file or directory.")
+	} else if err != nil {
+		return s.Reply(550, "SITE %s failed.", cmd)
+	}
+	return nil
+}
+
+// Handler for SITE HELP.
+func (s *fileSession) siteHelp() error {
+	var cmds []string
+	for cmd := range siteCommands {
+		cmds = append(cmds, cmd)
+	}
+	for cmd := range s.Site {
+		if siteCommands[cmd] == nil {
+			cmds = append(cmds, cmd)
+		}
+	}
+	cmds = append(cmds, "HELP")
+	sort.Strings(cmds)
+	return s.Reply(214, "The following SITE commands are recognized.\n%s\nHelp OK.",
+		strings.Join(cmds, " "))
+}
+
+// Handler for SITE CHMOD.
+func (s *fileSession) siteChmod(msg string) error {
+	fs, ok := s.FileSystem.(ChmodFS)
+	if !ok {
+		return errNotSupported
+	}
+	args := strings.SplitN(msg, " ", 2)
+	if len(args) < 2 {
+		return ErrInvalidSyntax
+	}
+	mode, err := strconv.ParseUint(args[0], 8, 32)
+	if err != nil || mode > 07777 {
+		return ErrInvalidSyntax
+	}
+	path := s.Path(args[1])
+	if err := s.access(AccessWrite, path); err != nil {
+		return err
+	}
+	if err := fs.Chmod(path, unixMode(mode)); err != nil {
+		return err
+	}
+	return s.Reply(200, "SITE CHMOD command ok.")
+}
+
+// Handler for SITE CHOWN. This accepts "CHOWN uid[:gid] path" with numeric
+// ids.
+func (s *fileSession) siteChown(msg string) error {
+	fs, ok := s.FileSystem.(ChownFS)
+	if !ok {
+		return errNotSupported
+	}
+	args := strings.SplitN(msg, " ", 2)
+	if len(args) < 2 {
+		return ErrInvalidSyntax
+	}
+	ids := strings.SplitN(args[0], ":", 2)
+	uid, err := strconv.Atoi(ids[0])
+	if err != nil || uid < 0 {
+		return ErrInvalidSyntax
+	}
+	gid := -1
+	if len(ids) > 1 {
+		if gid, err = strconv.Atoi(ids[1]); err != nil || gid < 0 {
+			return ErrInvalidSyntax
+		}
+	}
+	path := s.Path(args[1])
+	if err := s.access(AccessWrite, path); err != nil {
+		return err
+	}
+	if err := fs.Chown(path, uid, gid); err != nil {
+		return err
+	}
+	return s.Reply(200, "SITE CHOWN command ok.")
+}
+
+// Handler for SITE UMASK.
+func (s *fileSession) siteUmask(msg string) error {
+	if _, ok := s.FileSystem.(ChmodFS); !ok {
+		return errNotSupported
+	}
+	if msg == "" {
+		umask := os.FileMode(022)
+		if s.umasked {
+			umask = s.umask
+		}
+		return s.Reply(200, "Your current UMASK is %04o.", uint32(umask))
+	}
+	mask, err := strconv.ParseUint(msg, 8, 32)
+	if err != nil || mask > 0777 {
+		return ErrInvalidSyntax
+	}
+	s.umask, s.umasked = os.FileMode(mask), true
+	return s.Reply(200, "UMASK set to %04o.", mask)
+}
+
+// Handler for SITE SYMLINK. The user must be allowed to read the target.
+func (s *fileSession) siteSymlink(msg string) error {
+	fs, ok := s.FileSystem.(SymlinkFS)
+	if !ok {
+		return errNotSupported
+	}
+	args := strings.SplitN(msg, " ", 2)
+	if len(args) < 2 {
+		return ErrInvalidSyntax
+	}
+	path := s.Path(args[1])
+	if err := s.access(AccessWrite, path); err != nil {
+		return err
+	}
+	// The link must not expose a target the user may not read.
+	target := args[0]
+	if !pathpkg.IsAbs(target) {
+		target = pathpkg.Join(pathpkg.Dir(path), target)
+	}
+	if err := s.access(AccessRead, target); err != nil {
+		return err
+	}
+	if err := fs.Symlink(args[0], path); err != nil {
+		return err
+	}
+	return s.Reply(200, "SITE SYMLINK command ok.")
+}
+
+// Handler for SITE UTIME. This accepts "UTIME time path", and the form
+// "UTIME path atime mtime ctime UTC" used by some clients.
+func (s *fileSession) siteUtime(msg string) error {
+	fs, ok := s.FileSystem.(ChtimesFS)
+	if !ok {
+		return errNotSupported
+	}
+	var name string
+	var atime, mtime time.Time
+	var err error
+	if args := strings.Split(msg, " "); len(args) >= 5 && args[len(args)-1] == "UTC" {
+		n := len(args) - 4
+		name = strings.Join(args[:n], " ")
+		if atime, err = parseTime(args[n]); err != nil {
+			return ErrInvalidSyntax
+		}
+		if mtime, err = parseTime(args[n+1]); err != nil {
+			return ErrInvalidSyntax
+		}
+	} else if args := strings.SplitN(msg, " ", 2); len(args) == 2 {
+		name = args[1]
+		if mtime, err = parseTime(args[0]); err != nil {
+			return ErrInvalidSyntax
+		}
+		atime = mtime
+	} else {
+		return ErrInvalidSyntax
+	}
+	path := s.Path(name)
+	if err := s.access(AccessWrite, path); err != nil {
+		return err
+	}
+	if err := fs.Chtimes(path, atime, mtime); err != nil {
+		return err
+	}
+	return s.Reply(200, "SITE UTIME command ok.")
+}
+
+// Handler for SITE QUOTA.
+func (s *fileSession) siteQuota(msg string) error {
+	q, ok := s.quota()
+	if !ok {
+		return s.Reply(200, "No quota.")
+	}
+	u := s.usage()
+	limit := func(n int64) string {
+		if n <= 0 {
+			return "unlimited"
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	return s.Reply(200, strings.Join([]string{
+		"Quota for " + s.User + ":",
+		"Bytes used: " + strconv.FormatInt(u.Bytes, 10),
+		"Bytes limit: " + limit(q.Bytes),
+		"Files used: " + strconv.FormatInt(u.Files, 10),
+		"Files limit: " + limit(q.Files),
+		"End.",
+	}, "\n"))
+}
+
+// Apply the umask to a newly created file or directory, if one was set.
+func (s *fileSession) applyUmask(p string, perm os.FileMode) error {
+	fs, ok := s.FileSystem.(ChmodFS)
+	if !s.umasked || !ok {
+		return nil
+	}
+	return fs.Chmod(p, perm&^s.umask)
+}
+
+// Convert Unix permission bits to an os.FileMode.
+func unixMode(m uint64) os.FileMode {
+	mode := os.FileMode(m & 0777)
+	if m&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
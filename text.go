@@ -0,0 +1,151 @@
+package ftp
+
+import (
+	"bufio"
+	"io"
+	"unicode/utf8"
+)
+
+// Escape codes of record structure in stream mode, from RFC 959. Each follows
+// an escape byte, 0xFF. An escaped 0xFF is a data byte.
+const (
+	recordEscape = 0xFF
+	recordEOR    = 0x01 // End of record.
+	recordEOF    = 0x02 // End of file.
+)
+
+// A textReader decodes data received in TYPE A or E, or with record
+// structure. Records are ended with '\n'.
+type textReader struct {
+	r      *bufio.Reader
+	typ    string
+	cp     *CodePage
+	escape bool // Whether 0xFF escapes record markers.
+
+	cr  bool   // Whether a CR is held until the next byte is seen.
+	out []byte // Decoded data not yet returned.
+	err error  // Error to return once out is empty.
+}
+
+// Read implements io.Reader.
+func (r *textReader) Read(b []byte) (n int, err error) {
+	for len(r.out) < len(b) && r.err == nil {
+		if len(r.out) > 0 && r.r.Buffered() == 0 {
+			// Return what we have rather than wait for more data.
+			break
+		}
+		r.decode()
+	}
+	n = copy(b, r.out)
+	if n == len(r.out) {
+		r.out = r.out[:0]
+	} else {
+		r.out = r.out[n:]
+	}
+	if len(r.out) == 0 && r.err != nil {
+		err, r.err = r.err, nil
+	}
+	return n, err
+}
+
+// Decode the next byte.
+func (r *textReader) decode() {
+	c, err := r.r.ReadByte()
+	if err == errEOR {
+		// Records are ended by the block mode decoder.
+		r.endRecord()
+		return
+	} else if err != nil {
+		r.fail(err)
+		return
+	}
+	if r.escape && c == recordEscape {
+		d, err := r.r.ReadByte()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			r.fail(err)
+			return
+		}
+		if d != recordEscape {
+			if d&recordEOR != 0 {
+				r.endRecord()
+			}
+			if d&recordEOF != 0 {
+				r.fail(io.EOF)
+			}
+			return
+		}
+	}
+	r.char(c)
+}
+
+// Decode a data byte.
+func (r *textReader) char(c byte) {
+	switch r.typ {
+	case "A":
+		if r.cr {
+			r.cr = false
+			if c == '\n' {
+				r.out = append(r.out, '\n')
+				return
+			}
+			r.out = append(r.out, '\r')
+		}
+		if c == '\r' {
+			r.cr = true
+			return
+		}
+		r.out = append(r.out, c)
+	case "E":
+		r.out = utf8.AppendRune(r.out, r.cp[c])
+	default:
+		r.out = append(r.out, c)
+	}
+}
+
+// End a record with a newline.
+func (r *textReader) endRecord() {
+	r.flushCR()
+	r.out = append(r.out, '\n')
+}
+
+// Stop decoding with an error, after any held CR.
+func (r *textReader) fail(err error) {
+	r.flushCR()
+	r.err = err
+}
+
+func (r *textReader) flushCR() {
+	if r.cr {
+		r.cr = false
+		r.out = append(r.out, '\r')
+	}
+}
+
+// An escapeWriter doubles 0xFF bytes, for record structure in stream mode.
+type escapeWriter struct {
+	w byteWriter
+}
+
+// Write implements io.Writer.
+func (w *escapeWriter) Write(b []byte) (n int, err error) {
+	for _, c := range b {
+		if err := w.WriteByte(c); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// WriteByte implements io.ByteWriter.
+func (w *escapeWriter) WriteByte(c byte) error {
+	if c == recordEscape {
+		if err := w.w.WriteByte(c); err != nil {
+			return err
+		}
+	}
+	return w.w.WriteByte(c)
+}
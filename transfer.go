@@ -0,0 +1,93 @@
+package ftp
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"sync/atomic"
+)
+
+var errAborted = errors.New("transfer aborted")
+
+// A transfer in progress.
+type transfer struct {
+	cmd  string // Command that started the transfer.
+	path string // Path being transferred.
+	n    int64  // Bytes transferred. This is accessed atomically.
+}
+
+// A countReader counts bytes read from r.
+type countReader struct {
+	r io.Reader
+	n *int64
+}
+
+// Read implements io.Reader.
+func (c *countReader) Read(b []byte) (n int, err error) {
+	n, err = c.r.Read(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// Copy from src to dst for the transfer command c, while handling commands
+// on the control channel. ABOR interrupts the copy, which then returns
+// errAborted. STAT and NOOP are answered immediately. Other commands are
+// queued until the transfer is done.
+func (s *fileSession) copy(c *Command, path string, dst io.Writer, src io.Reader) (int64, error) {
+	xfer := &transfer{cmd: c.Cmd, path: path}
+	s.xfer = xfer
+	defer func() { s.xfer = nil }()
+
+	data := s.Data
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(dst, &countReader{src, &xfer.n})
+		done <- err
+	}()
+
+	in := s.incoming()
+	for {
+		select {
+		case err := <-done:
+			return atomic.LoadInt64(&xfer.n), err
+		case r, ok := <-in:
+			if !ok || r.err != nil {
+				// The control channel is gone, so give up on the transfer.
+				data.Abort()
+				<-done
+				if !ok {
+					return atomic.LoadInt64(&xfer.n), errSessionClosed
+				}
+				return atomic.LoadInt64(&xfer.n), r.err
+			}
+			switch r.cmd.Cmd {
+			case "ABOR":
+				data.Abort()
+				<-done
+				s.aborted = true
+				s.queue = append(s.queue, r.cmd)
+				return atomic.LoadInt64(&xfer.n), errAborted
+			case "STAT":
+				if err := s.send(211, s.status()); err != nil {
+					return atomic.LoadInt64(&xfer.n), err
+				}
+			case "NOOP":
+				if err := s.send(200, "OK."); err != nil {
+					return atomic.LoadInt64(&xfer.n), err
+				}
+			default:
+				s.queue = append(s.queue, r.cmd)
+			}
+		}
+	}
+}
+
+// Return the status of the transfer in progress.
+func (s *fileSession) transferStatus() string {
+	x := s.xfer
+	if x == nil {
+		return "No transfer in progress"
+	}
+	n := atomic.LoadInt64(&x.n)
+	return x.cmd + " " + x.path + ": " + strconv.FormatInt(n, 10) + " bytes transferred"
+}